@@ -23,12 +23,16 @@ package main
 import (
 	"bytes"
 	"container/list"
+	"context"
 	"encoding/csv"
 	"fmt"
 	"github.com/droundy/goopt"
+	"io"
 	"log"
+	"math/rand"
 	"net"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
@@ -36,12 +40,23 @@ import (
 )
 
 type Parameters struct {
-	Debug      *bool
-	TestsFile  *string
-	OutputFile *string
-	MyHost     *string
-	MaxStreams *int
-	Timeout    *string
+	Debug       *bool
+	TestsFile   *string
+	OutputFile  *string
+	MyHost      *string
+	MaxStreams  *int
+	Timeout     *string
+	Traceroute  *bool
+	Tags        *string
+	Sheet       *string
+	OutputBook  *string
+	OutputJSON  *string
+	OutputJUnit *string
+	OutputProm  *string
+	Groups      *string
+	Format      *string
+	Listen      *string
+	Interval    *string
 }
 
 var params Parameters
@@ -55,21 +70,26 @@ var semStreams semaphore
 // Expanded tests (one per port) are children of this, so we can iterate over them
 
 type Test struct {
-	ref      string
-	desc     string
-	lhost    string
-	laddr    string
-	ldesc    string
-	rhost    string
-	raddr    string
-	rdesc    string
-	net      string
-	ipv6     bool // test with underlying AF_INET6 socket
-	attempt  bool // should this test be attempted. e.g. does the hostname match?
-	run      bool
-	passed   bool
-	error    string
-	subTests list.List // There is always at least one
+	ref        string
+	desc       string
+	lhost      string
+	laddr      string
+	ldesc      string
+	rhost      string
+	raddr      string
+	rdesc      string
+	net        string
+	ipv6       bool // test with underlying AF_INET6 socket
+	dual       bool // run over both IPv4 and IPv6, see DualSuffix
+	attempt    bool // should this test be attempted. e.g. does the hostname match?
+	run        bool
+	passed     bool
+	start      time.Time     // when it started running
+	elapsed    time.Duration // how long all its subTests took
+	asymmetric bool          // a dual test that passed over one family and failed over the other
+	error      string
+	opts       *TestOptions // shared with the subTests
+	subTests   list.List    // There is always at least one
 }
 
 // All subtests must be of the same kind as the parent, but the source and dest addresses/ports can be different.
@@ -81,12 +101,40 @@ type SubTest struct {
 	ipv6       bool   // test with underlying AF_INET6 socket
 	laddr_used string // the local address that ended up being used for this test
 	raddr_used string // the remote address we connected to for this test
+	rname      string // the host name raddr was resolved from, for resolve=all
+	attempts   int    // how many times the probe was run, including retries
 	run        bool
 	passed     bool
 	refused    bool
+	rtt        time.Duration // round trip or connect time, if the test type measures it
+	state      string        // what came back from the far end, for the test types that can tell. See StateAnswered etc.
+	info       string        // what an application level probe found out, e.g. the DNS answers
 	error      string
+	opts       *TestOptions
 }
 
+// A protocol ending in this runs the test over both IPv4 and IPv6, e.g. tcp+dual is tcp4 and tcp6
+const DualSuffix = "+dual"
+
+// Retries of a failed subTest
+const (
+	DefaultBackoff = time.Second // before the first retry, if the test doesn't set backoff
+	MaxRetries     = 10
+	MaxRetryDelay  = time.Minute // the backoff stops doubling here
+)
+
+// What came back from the far end
+const (
+	StateAnswered = "answered" // connected, or the service replied
+	StateSilent   = "silent"   // nothing at all
+	StateRejected = "rejected" // refused, or an ICMP error
+)
+
+// --timeout, parsed once at startup
+var Timeout = DefaultTimeout
+
+const DefaultTimeout = 5 * time.Second
+
 var ValidTests uint
 var TestsInFile []Test
 
@@ -96,6 +144,28 @@ var debug debugging = !true // or flip to false
 
 type debugging bool
 
+// Output formats, for --format
+const (
+	FormatLog    = "log"
+	FormatNagios = "nagios"
+	FormatTAP    = "tap"
+)
+
+// Give up on the run, e.g. over a bad test file. A Nagios plugin has to say why on stdout, and exit UNKNOWN rather
+// than 1, which would be WARNING.
+func fatalf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	if params.Format != nil && *params.Format == FormatNagios {
+		fmt.Println("CONCHK UNKNOWN - " + msg)
+		os.Exit(NagiosUnknown)
+	}
+	log.Fatal(msg)
+}
+
+func fatal(v ...interface{}) {
+	fatalf("%s", strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
 func (d debugging) Println(args ...interface{}) {
 	if d {
 		log.Println(append([]interface{}{"DEBUG:"}, args...)...)
@@ -115,17 +185,87 @@ func init() {
 	goopt.Version = "0.3"
 	goopt.Summary = "conchk is an IP connectivity test tool designed to validate that all configured IP connectivity actually works\n " +
 		"It reads a list of tests and executes them, in a parallel manner, based on the contents of each line" +
-		"conchk supports tcp and udp based tests (IPv4 and IPv6), at this time.\n\n" +
+		"conchk supports tcp, udp and (on Linux) sctp based tests (IPv4 and IPv6), and ICMP echo (ping) tests using ip4:icmp or ip6:ipv6-icmp.\n" +
+		"It also has application level probes: dns (dns4, dns6) and dns+tcp (dns+tcp4, dns+tcp6) send a real query and check the reply,\n" +
+		"ntp (ntp4, ntp6) makes an SNTP request and reports the server's stratum and our clock offset,\n" +
+		"tls (tls4, tls6) completes a TLS handshake and reports on and checks the server's certificate,\n" +
+		"and http and https (http4, http6, https4, https6) make a request and check the response.\n" +
+		"On Linux pmtu (pmtu4, pmtu6) finds the path MTU with DF-set UDP packets, or ICMP echoes for pmtu4:icmp and pmtu6:ipv6-icmp.\n\n" +
 		"==Notes==\n" +
-		"* The incuded Excel sheet is a useful way to create and maintain the tests\n" +
+		"* The incuded Excel sheet is a useful way to create and maintain the tests. Save it as .xlsx or .ods and conchk can read it directly\n" +
 		"* testing a range of supports is supported. In this case the rules for a successful test are somewhat different\n" +
 		"** If one of the ports gets a successful connect, and the rest are refused (connection refused) as nothing is listening\n" +
 		"\tthen this is considered to be a successful test of the range. This is the most common scenario in our experience;\n" +
 		"\tthe firewalls and routing are demonstrably working, and at least one destination service is ok. If you need all ports to work\n" +
-		"\tthen consider using individual tests\n" +
+		"\tthen consider using individual tests, or pass=all\n" +
+		"* RemoteIP:Port can be a list of hosts and CIDR blocks, then a list of ports and port ranges, e.g. 10.1.2.0/28,web1:80,443,8000-8010.\n" +
+		"\tEvery host is tested on every port, and the same rules as a range apply\n" +
+		"* UDP tests are failed by any ICMP error for the datagram. As root conchk listens for them directly, otherwise it relies on\n" +
+		"\tthe socket reporting them: every ICMP error on Linux (IP_RECVERR), only port unreachable elsewhere\n" +
+		"* With --traceroute (or traceroute=yes on the test) a failed tcp or udp test is retried with increasing TTLs, and the\n" +
+		"\tlast router to answer is added to the error. It uses the same addresses and ports, so should hit the same firewall rules\n" +
+		"* pmtu tests send UDP to the test's port (33434 if none is given), which should be closed or answer anything: a reply or a\n" +
+		"\tport unreachable shows the packet got there. They fail if packets vanish without a Fragmentation Needed or Packet Too Big\n" +
+		"\tcoming back (an MTU black hole), or if the path MTU is below minmtu. Each probe is given up on after a second, and the\n" +
+		"\twhole search after the test's timeout, so a path with a black hole may need timeout=30s or so\n" +
+		"* Adding +dual to a protocol (tcp+dual, https+dual etc) runs the test over IPv4 and then IPv6, as if it were written\n" +
+		"\tonce as tcp4 and once as tcp6. Each family has to pass by itself; if only one does the result is ASYMMETRIC rather than\n" +
+		"\tFAILED, as that is usually a firewall rule, route or listener that was only set up for one of them\n" +
 		"* If all tests for this host pass, then conchk will exit(0). Otherwise it will exit(1)\n" +
 		"* conchk will use the current hostname, or the commandline parameter, to find the tests approprate to execute - matches on field 3.\n" +
 		"\tThis means all the tests for a system, or project can be placed in one file\n" +
+		"\tField 3 can also be a glob (web-*), a regular expression between slashes (/^web-[0-9]+$/) or @group for any host in a\n" +
+		"\tgroup. Groups are lines of name,member,member... in the --groups file, or a \"groups\" object of name: [members] in a\n" +
+		"\tJSON test file. Members can be names, patterns or other @groups\n" +
+		"* Tests can also be written in JSON, in a file ending .json: {\"tests\": [{\"ref\": \"1\", \"host\": \"web01\", \"remote\": \"10.0.0.1:443\",\n" +
+		"\t\"protocol\": \"tls4\", \"options\": {\"minvalidity\": \"14d\"}}]}. The other fields are description, local, local_description,\n" +
+		"\tremote_host, remote_description, expect, payload and tags. An array option value is joined with commas, or repeats the\n" +
+		"\toption for answer and header\n" +
+		"* --tests can also be an .xlsx or .ods workbook, with the same columns as the CSV on the first worksheet or the one named by\n" +
+		"\t--sheet. Rows starting with # are comments. --outputbook writes a copy of it with the Result and Summary columns filled in\n" +
+		"* Per-test options go in the columns after Summary, one key=value per column:\n" +
+		"\tpayload=hex:<hex> or payload=file:<path> replaces the UDP test datagram\n" +
+		"\tresponse=any, response=exact:<hex>, response=prefix:<hex> or response=regex:<regexp> makes a UDP test pass only if\n" +
+		"\tthe service answers with a matching reply, rather than if no ICMP error comes back\n" +
+		"\tqname=<name> and qtype=<type> set the dns query (default . NS), rcode=<rcode or any> the expected RCODE (default NOERROR),\n" +
+		"\tand answer=<value> requires that value in the answer section. answer can be repeated\n" +
+		"\tmaxstratum=<n> and maxoffset=<duration> fail an ntp test on a poorly synchronised server, or local clock\n" +
+		"\tsni=<name>, alpn=<proto,proto>, tlsmin=<1.0-1.3> and cafile=<pem bundle> control the tls handshake and verification.\n" +
+		"\tminvalidity=<duration, or days e.g. 14d> fails certificates close to expiry, verify=no reports but accepts untrusted ones\n" +
+		"\tmethod=<GET etc>, path=</path> and host=<Host header> make the http request, which passes if status=<200,3xx etc> matches\n" +
+		"\t(by default anything below 400), every header=<Name or Name: value> is present and the body contains body=<text>.\n" +
+		"\thttps tests also take the sni, tlsmin, cafile, verify and minvalidity options\n" +
+		"\tladdrs=<ip,ip> and raddrs=<ip,ip> add local and remote addresses to a multi-homed sctp association\n" +
+		"\tminmtu=<bytes> fails a pmtu test with a lower path MTU, and maxmtu=<bytes> is the largest packet tried (default 1500)\n" +
+		"\tpass=<range, any, all, quorum, none or a number> is how many of a range must connect. range is the default described\n" +
+		"\tabove, any needs one whatever happens to the rest, all needs every one, quorum more than half, a number at least that\n" +
+		"\tmany and none needs every one to fail. refusedok=yes counts a refused port as connecting, for any of them\n" +
+		"\tresolve=all tests every address the remote host name resolves to (of the protocol's family), as if they were all\n" +
+		"\tlisted, instead of whichever one the dialer picks. Unless pass is given every address must pass, and the Summary\n" +
+		"\tcolumn of the .csv output lists each address's result. With --listen the name is looked up again for every run\n" +
+		"\ttimeout=<duration> overrides --timeout for the test. retries=<n> (up to 10) tries a failed probe again that many\n" +
+		"\ttimes, unless it was refused or got an ICMP error. The first retry waits for backoff=<duration> (default 1s), doubling\n" +
+		"\teach time after, less a random amount of up to half. The Summary column of the .csv output says how many attempts it took\n" +
+		"\ttraceroute=<yes or no> overrides --traceroute for the test\n" +
+		"\ttags=<tag,tag> lets --tags pick out the test\n" +
+		"\texpect=<allow, deny, reject or drop> says what should happen to the flow. The default is allow; deny passes if the\n" +
+		"\tflow is blocked either way, reject only if it is actively refused (TCP RST, ICMP error) and drop only if there is\n" +
+		"\tno response at all. Every port of a range must then be blocked as expected. A udp test needs response= for deny and\n" +
+		"\tdrop, since without a reply to wait for an open flow is as silent as a dropped one\n" +
+		"* --outputjson writes the results of this host's tests as JSON, with the run's start and end times, and every subtest's\n" +
+		"\taddresses (as given and as used), state, round trip time, attempts and error. Times are in milliseconds\n" +
+		"* --outputjunit writes a JUnit XML report, with a testcase per test. Failures have the error, and each subtest is a property\n" +
+		"\tof its testcase. Tests for other hosts, or left out by --tags, are there as skipped\n" +
+		"* --format=nagios makes conchk a Nagios/Icinga plugin: a status line with perfdata (pass counts, each test's RTT) on stdout\n" +
+		"\tand exit 0 for OK, 1 for WARNING (a dual test that only works over one family, or a test that needed a retry),\n" +
+		"\t2 for CRITICAL (any other failure) and 3 for UNKNOWN (no tests for this host, or a bad test file). --format=tap prints\n" +
+		"\tTAP on stdout instead, with a failed test's subtests as diagnostics, and the log still goes to stderr\n" +
+		"* --listen=<address> keeps conchk running, running the tests every --interval, and serves Prometheus metrics on /metrics:\n" +
+		"\tconchk_test_up, _rtt_seconds, _duration_seconds, _last_success_timestamp_seconds and _subtests (by passed, refused and\n" +
+		"\tfailed) for each test, labelled by ref, protocol and destination, and conchk_subtest_up, _refused, _rtt_seconds and\n" +
+		"\t_attempts for each subtest, labelled by subtest too. The output files aren't written in this mode\n" +
+		"* --outputprom writes the same metrics to a file for node_exporter's textfile collector, e.g. from cron. It is written to\n" +
+		"\ta temporary file and renamed, and a failed test's last success time is kept from the file it replaces\n" +
 		"* The .csv output option will write a file much like the input file, but with two additional columns and without any comments\n" +
 		"\t This file can be fed back into conchk without error.\n\n" +
 		"See http://bwooce.github.io/conchk/ for more information.\n\n(c)2013 Bruce Fitzsimons.\n\n"
@@ -135,29 +275,49 @@ func init() {
 	params.Debug = goopt.Flag([]string{"-d", "--debug"}, []string{}, "additional debugging output", "")
 	params.TestsFile = goopt.String([]string{"-T", "--tests"}, "./tests.conchk", "test file to load")
 	params.OutputFile = goopt.String([]string{"-O", "--outputcsv"}, "", "name of results .csv file to write to. A pre-existing file will be overwritten.")
+	params.Sheet = goopt.String([]string{"--sheet"}, "", "worksheet to read the tests from, when --tests is an .xlsx or .ods workbook. Defaults to the first")
+	params.OutputJSON = goopt.String([]string{"--outputjson"}, "", "name of results .json file to write, with every subtest's details. A pre-existing file will be overwritten.")
+	params.OutputJUnit = goopt.String([]string{"--outputjunit"}, "", "name of JUnit XML report to write, for CI systems. A pre-existing file will be overwritten.")
+	params.OutputProm = goopt.String([]string{"--outputprom"}, "", "name of a Prometheus textfile to write, for node_exporter's textfile collector (it must end in .prom). It is replaced atomically.")
+	params.OutputBook = goopt.String([]string{"--outputbook"}, "", "name of a copy of the --tests workbook to write, with the results filled in. A pre-existing file will be overwritten.")
 	params.MyHost = goopt.String([]string{"-H", "--host"}, Hostname, "Hostname to use for config lookup")
+	params.Groups = goopt.String([]string{"--groups"}, "", "file of host groups, for @group in the Hostname column")
 	params.MaxStreams = goopt.Int([]string{"--maxstreams"}, 8, "Maximum simultaneous checks")
-	params.Timeout = goopt.String([]string{"--timeout"}, "5s", "TCP connectivity timeout, UDP delay for ICMP responses")
+	params.Timeout = goopt.String([]string{"--timeout"}, DefaultTimeout.String(), "TCP connectivity timeout, UDP delay for ICMP responses, unless the test sets timeout")
+	params.Traceroute = goopt.Flag([]string{"--traceroute"}, []string{}, "traceroute failed tcp and udp tests to find where the flow dies (needs root)", "")
+	params.Format = goopt.Alternatives([]string{"--format"}, []string{FormatLog, FormatNagios, FormatTAP}, "log for the usual log lines, nagios to act as a Nagios/Icinga plugin, tap for TAP on stdout")
+	params.Listen = goopt.String([]string{"--listen"}, "", "run the tests every --interval, and serve Prometheus metrics on /metrics at this address, e.g. :9117")
+	params.Interval = goopt.String([]string{"--interval"}, "1m", "how often to run the tests, with --listen")
+	params.Tags = goopt.String([]string{"--tags"}, "", "only run tests with one of these comma separated tags")
 
-	semStreams = make(semaphore, *params.MaxStreams)
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
 }
 
 func main() {
+	// get command line options
+	goopt.Parse(nil)
+	debug = debugging(*params.Debug)
+	semStreams = make(semaphore, *params.MaxStreams)
+	if timeout, err := time.ParseDuration(*params.Timeout); err != nil || timeout <= 0 {
+		fatalf("Invalid --timeout %q: it must be a duration more than 0, like 5s", *params.Timeout)
+	} else {
+		Timeout = timeout
+	}
+	if *params.Format == FormatNagios && !*params.Debug {
+		log.SetOutput(io.Discard) // a plugin's output is its status line, and some monitoring systems read stderr too
+	}
+
 	log.Println("--------------------------", "conchk v"+goopt.Version, "--------------------------")
+	start := time.Now()
 	gotRoot = true
 	if os.Getuid() != 0 {
 		gotRoot = false
 		log.Println("WARNING: conchk must run as root for full functionality (ICMP listens, low port access etc)")
 	}
 
-	// get command line options
-	goopt.Parse(nil)
-	debug = debugging(*params.Debug)
-
 	/*	if !validateOptions() {
-		log.Fatal("Incompatible options")
+		fatal("Incompatible options")
 	} */
 
 	// read file or fail doing it
@@ -169,24 +329,13 @@ func main() {
 		go icmpListen(true, inputChan)
 	}
 
-	// loop over each connection, in a new thread
-	for idx, _ := range TestsInFile {
-		/*if tt.ipv6 && !net.supportsIPv6 {
-					log.Println("IPv6 not supported")
-		            continue
-		        }*/
-		if TestsInFile[idx].attempt {
-			semStreams.acquire(1) // or block until one slot is free
-			//fmt.Println("Going to run a goroutine")
-			go runTest(&TestsInFile[idx], p)
-		}
+	if *params.Listen != "" {
+		runExporter(p) // never returns
 	}
-
-	debug.Println("going to wait for all goroutines to complete")
-	semStreams.acquire(*params.MaxStreams) // don't exit until all goroutines are complete
-	debug.Println("all complete")
+	runTests(p)
 
 	log.Println("--------------------- TESTING RUN COMPLETED ---------------------")
+	end := time.Now()
 	var numPassed uint
 	for _, test := range TestsInFile {
 		if test.attempt {
@@ -200,7 +349,7 @@ func main() {
 	log.Println("--------------------------", goopt.Description(), "--------------------------")
 
 	if *params.OutputFile != "" {
-		const hdr = "#format is: TestRef,TestDescription,Hostname,LocalIP:Port,LocalDescription[u],RemoteHost[u],RemoteIP:Port,RemoteDescription[u],Protocol(tcp,udp,tcp4 etc),Result[o],Summary[o]\n# [u] fields are currently unused, [o] are optional\n"
+		const hdr = "#format is: TestRef,TestDescription,Hostname,LocalIP:Port,LocalDescription[u],RemoteHost[u],RemoteIP:Port,RemoteDescription[u],Protocol(tcp,udp,tcp4 etc),Result[o],Summary[o],Options[o]...\n# [u] fields are currently unused, [o] are optional\n"
 		buf := bytes.NewBufferString(hdr)
 		fd, err := os.OpenFile(*params.OutputFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0655)
 		if err == nil {
@@ -213,30 +362,115 @@ func main() {
 			}
 			w.Flush()
 		} else {
-			log.Printf("Cannot open file %s due to error %s: skipping and exiting with error", *params.OutputFile, err)
-			os.Exit(1)
+			fatalf("Cannot open file %s due to error %s: skipping and exiting with error", *params.OutputFile, err)
+		}
+	}
+
+	if *params.OutputJSON != "" {
+		results := newJSONResults(*params.MyHost, start, end, TestsInFile)
+		if err := results.write(*params.OutputJSON); err != nil {
+			fatalf("Cannot write JSON results %s due to error %s: exiting with error", *params.OutputJSON, err)
+		}
+	}
+
+	if *params.OutputJUnit != "" {
+		report := newJUnitReport(*params.MyHost, start, end, TestsInFile)
+		if err := report.write(*params.OutputJUnit); err != nil {
+			fatalf("Cannot write JUnit report %s due to error %s: exiting with error", *params.OutputJUnit, err)
 		}
 	}
 
+	if *params.OutputProm != "" {
+		if err := writeTextfile(*params.OutputProm, TestsInFile, start, end); err != nil {
+			fatalf("Cannot write Prometheus textfile %s due to error %s: exiting with error", *params.OutputProm, err)
+		}
+	}
+
+	if *params.OutputBook != "" {
+		if TestsWorkbook == nil {
+			fatalf("Cannot write %s as the tests weren't read from a workbook: exiting with error", *params.OutputBook)
+		}
+		if err := TestsWorkbook.writeResults(*params.OutputBook, TestsInFile); err != nil {
+			fatalf("Cannot write workbook %s due to error %s: exiting with error", *params.OutputBook, err)
+		}
+	}
+
+	switch *params.Format {
+	case FormatNagios:
+		status, code := nagiosReport(*params.MyHost, TestsInFile, end.Sub(start))
+		fmt.Print(status)
+		os.Exit(code)
+	case FormatTAP:
+		fmt.Print(tapReport(TestsInFile))
+	}
+
 	if numPassed != ValidTests {
 		os.Exit(1) // indicate an error
 	}
 	os.Exit(0)
 }
 
+// Run this host's tests, MaxStreams at a time, and wait for them all to finish
+func runTests(p *ICMPPublisher) {
+	// loop over each connection, in a new thread
+	for idx, _ := range TestsInFile {
+		/*if tt.ipv6 && !net.supportsIPv6 {
+					log.Println("IPv6 not supported")
+		            continue
+		        }*/
+		if TestsInFile[idx].attempt {
+			semStreams.acquire(1) // or block until one slot is free
+			//fmt.Println("Going to run a goroutine")
+			go runTest(&TestsInFile[idx], p)
+		}
+	}
+
+	debug.Println("going to wait for all goroutines to complete")
+	semStreams.acquire(*params.MaxStreams) // don't exit until all goroutines are complete
+	semStreams.release(*params.MaxStreams) // ready for the next run, when there is one
+	debug.Println("all complete")
+}
+
 func getTestsFromFile() {
 	log.Println("Reading tests for", *params.MyHost, "from file", *params.TestsFile)
+	if *params.Groups != "" {
+		file, err := os.Open(*params.Groups)
+		if err != nil {
+			fatal("Cannot open", *params.Groups, "due to error", err)
+		}
+		groups, err := readHostGroups(file)
+		file.Close()
+		if err == nil {
+			err = addHostGroups(groups)
+		}
+		if err != nil {
+			fatal("Cannot read host groups from", *params.Groups, "due to error", err)
+		}
+	}
 	if params.TestsFile != nil {
 		file, err := os.Open(*params.TestsFile)
 		if err != nil {
-			log.Fatal("Cannot open", *params.TestsFile, "due to error", err)
+			fatal("Cannot open", *params.TestsFile, "due to error", err)
+		}
+		defer file.Close()
+
+		var tests [][]string
+		switch strings.ToLower(filepath.Ext(*params.TestsFile)) {
+		case ".json":
+			var groups map[string][]string
+			if tests, groups, err = readJSONTests(file); err == nil {
+				err = addHostGroups(groups)
+			}
+		case ".xlsx", ".ods":
+			tests, TestsWorkbook, err = readWorkbookTests(file, *params.Sheet)
+		default:
+			cr := csv.NewReader(file)
+			cr.Comment = '#'
+			cr.FieldsPerRecord = -1 // options are optional
+			tests, err = cr.ReadAll()
 		}
-		cr := csv.NewReader(file)
-		cr.Comment = '#'
-
-		tests, err := cr.ReadAll()
 		if err != nil {
-			log.Fatal("Cannot read tests from", *params.TestsFile, "due to error", err)
+			fatal("Cannot read tests from", *params.TestsFile, "due to error", err)
 		}
 		//fmt.Println("looking for tests for", *params.MyHost)
 		for _, test := range tests {
@@ -250,10 +484,10 @@ func getTestsFromFile() {
 					_, aport, err := net.SplitHostPort(test.laddr)
 					port, err2 := strconv.ParseUint(aport, 0, 32)
 					if err != nil || err2 != nil {
-						log.Fatal("Invalid local address on test:", fmtTest(test))
+						fatal("Invalid local address on test:", fmtTest(test))
 					}
 					if port > 0 && port < 1024 {
-						log.Fatal("Cannot execute test w/o root access:", fmtTest(test))
+						fatal("Cannot execute test w/o root access:", fmtTest(test))
 					}
 				}
 			}
@@ -267,10 +501,8 @@ func appendTest(test []string) {
 
 	var newTest Test
 
-	newTest.lhost = strings.TrimSpace(test[2])
-	if newTest.lhost == *params.MyHost {
-		newTest.attempt = true
-		ValidTests++
+	if len(test) < 9 {
+		fatalf("Test %q has %d fields, it needs at least 9", strings.Join(test, ","), len(test))
 	}
 	newTest.ref = strings.TrimSpace(test[0])
 	newTest.desc = strings.TrimSpace(test[1])
@@ -285,34 +517,47 @@ func appendTest(test []string) {
 	newTest.ldesc = strings.TrimSpace(test[4])
 	newTest.rhost = strings.TrimSpace(test[5])
 	newTest.raddr = strings.TrimSpace(test[6])
-	newTest.ldesc = strings.TrimSpace(test[7])
+	newTest.rdesc = strings.TrimSpace(test[7])
 	newTest.net = strings.TrimSpace(test[8])
 
-	address, startPort, endPort := findDestRange(newTest.raddr)
-	debug.Printf("iterating from %d to %d", startPort, endPort+1)
-
-	for cnt := 0; cnt < (endPort-startPort)+1; cnt++ {
-		debug.Printf("Adding test for dest port %d", startPort+cnt)
-		var newSubTest SubTest
+	var err error
+	if len(test) > 11 {
+		newTest.opts, err = parseTestOptions(test[11:])
+	} else {
+		newTest.opts, err = parseTestOptions(nil)
+	}
+	if err != nil {
+		fatalf("Invalid options on test %s: %v", newTest.ref, err)
+	}
+	if err = checkExpectOption(newTest.net, newTest.opts); err != nil {
+		fatalf("Invalid options on test %s: %v", newTest.ref, err)
+	}
 
-		if startPort != endPort && startPort != 0 {
-			newSubTest.subref = fmt.Sprintf("%s.%d", newTest.ref, cnt+1)
+	newTest.lhost = strings.TrimSpace(test[2])
+	match, err := hostMatches(newTest.lhost, *params.MyHost)
+	if err != nil {
+		fatalf("Invalid Hostname %q on test %s: %v", newTest.lhost, newTest.ref, err)
+	}
+	if match && newTest.opts.hasTag(*params.Tags) {
+		if err = newTest.opts.loadFiles(); err != nil {
+			fatalf("Invalid options on test %s: %v", newTest.ref, err)
 		}
+		newTest.attempt = true
+		ValidTests++ // once per test, however many ways the host matches it
+	}
 
-		// these three are not currently mutable per subTest, but are convenient to have here
-		newSubTest.net = newTest.net
-		newSubTest.ipv6 = newTest.ipv6
-		newSubTest.laddr = newTest.laddr
-
-		if startPort == 0 {
-			newSubTest.raddr = address
-		} else {
-			newSubTest.raddr = fmt.Sprintf("%s:%d", address, startPort+cnt)
+	// a dual stack test is the same test once over each family, e.g. tcp+dual is tcp4 and tcp6
+	if proto := strings.TrimSuffix(newTest.net, DualSuffix); proto != newTest.net {
+		if !hasFamilies(proto) {
+			fatalf("Protocol %s on test %s has no IPv4 and IPv6 variants to run", newTest.net, newTest.ref)
 		}
-
-		newTest.subTests.PushBack(&newSubTest)
+		newTest.dual = true
+	} else {
+		newTest.ipv6 = familySuffix(strings.Split(newTest.net, ":")[0]) == "6" || isV6(newTest.raddr)
 	}
 
+	newTest.buildSubTests()
+
 	l := len(TestsInFile)
 	if l+1 > cap(TestsInFile) { // reallocate
 		// Allocate double what's needed, for future growth.
@@ -326,6 +571,193 @@ func appendTest(test []string) {
 	debug.Printf("TestsInFile l=%d, len is %d, cap is %d", l, len(TestsInFile), cap(TestsInFile))
 }
 
+// One subTest per destination the test expands to, in each family for a dual test. With resolve=all, names are looked
+// up now, so this is done again before each run when conchk keeps running.
+func (test *Test) buildSubTests() {
+	families := []string{familySuffix(strings.Split(test.net, ":")[0])}
+	if test.dual {
+		families = []string{"4", "6"}
+	}
+	test.subTests.Init()
+
+	for _, family := range families {
+		dests, err := expandDest(test.raddr)
+		if err != nil {
+			fatalf("Invalid RemoteIP:Port %q on test %s: %v", test.raddr, test.ref, err)
+		}
+		var names map[string]string
+		if test.attempt && test.opts.resolveAll { // no point looking up names for other hosts' tests
+			dests, names = resolveDests(dests, family)
+		}
+		total, ports := 0, 0
+		for _, hostDests := range dests {
+			total += len(hostDests)
+			if len(hostDests) > ports {
+				ports = len(hostDests)
+			}
+		}
+
+		for h, hostDests := range dests {
+			for p, raddr := range hostDests {
+				debug.Printf("Adding test for dest %s", raddr)
+				var subTest SubTest
+
+				// ref.host.port when there are several of both, otherwise just count them
+				switch {
+				case len(dests) > 1 && ports > 1:
+					subTest.subref = fmt.Sprintf("%s.%d.%d", test.ref, h+1, p+1)
+				case total > 1:
+					subTest.subref = fmt.Sprintf("%s.%d", test.ref, h*ports+p+1)
+				}
+
+				subTest.net = test.net
+				subTest.ipv6 = test.ipv6 || isV6(raddr)
+				if test.dual {
+					if subTest.subref == "" {
+						subTest.subref = test.ref
+					}
+					subTest.subref += ".v" + family
+					subTest.net = strings.TrimSuffix(test.net, DualSuffix) + family
+					subTest.ipv6 = family == "6"
+				}
+				// these are not currently mutable per subTest, but are convenient to have here
+				subTest.laddr = test.laddr
+				subTest.opts = test.opts
+				subTest.raddr = raddr
+				subTest.rname = names[raddr]
+
+				test.subTests.PushBack(&subTest)
+			}
+		}
+	}
+}
+
+// Expand a destination into the addresses to test, grouped by host. It can be a list of hosts, then a list of ports:
+// 10.0.0.1,10.0.0.2:80,443,8000-8010. The hosts can be CIDR blocks, and the ports can be ranges. Anything that
+// isn't a port number, like a service name, is left for the dialer to deal with.
+func expandDest(dest string) ([][]string, error) {
+	hostList, portList, hasPorts := dest, "", false
+	if i := strings.LastIndex(dest, ":"); i > strings.LastIndex(dest, "]") {
+		hostList, portList, hasPorts = dest[:i], dest[i+1:], true
+	}
+
+	var hosts []string
+	for _, host := range strings.Split(hostList, ",") {
+		host = strings.TrimSpace(host)
+		if !strings.Contains(host, "/") {
+			hosts = append(hosts, host)
+			continue
+		}
+		block, err := expandCIDR(host)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, block...)
+	}
+
+	dests := make([][]string, 0, len(hosts))
+	for _, host := range hosts {
+		var hostDests []string
+		for _, port := range strings.Split(portList, ",") {
+			IPPort := host
+			if hasPorts {
+				IPPort += ":" + strings.TrimSpace(port)
+			}
+			address, startPort, endPort := findDestRange(IPPort)
+			if startPort == 0 {
+				hostDests = append(hostDests, address)
+				continue
+			}
+			for port := startPort; port <= endPort; port++ {
+				hostDests = append(hostDests, fmt.Sprintf("%s:%d", address, port))
+			}
+		}
+		dests = append(dests, hostDests)
+	}
+	return dests, nil
+}
+
+// For resolve=all: every address a destination's host name resolves to, in its place, each address with all the
+// ports the name had. Also returns the name each new destination came from. Names that don't resolve are left as they
+// are, for the dialer to report on.
+func resolveDests(dests [][]string, family string) ([][]string, map[string]string) {
+	var resolved [][]string
+	names := make(map[string]string)
+	for _, hostDests := range dests {
+		host, _, err := net.SplitHostPort(hostDests[0])
+		if err != nil {
+			host = hostDests[0]
+		}
+		host = strings.Trim(host, "[]")
+		if net.ParseIP(host) != nil {
+			resolved = append(resolved, hostDests)
+			continue
+		}
+		ips, err := net.DefaultResolver.LookupIP(context.Background(), "ip"+family, host)
+		if err != nil || len(ips) == 0 {
+			debug.Printf("Cannot resolve %s: %v", host, err)
+			resolved = append(resolved, hostDests)
+			continue
+		}
+		for _, ip := range ips {
+			addr := ip.String()
+			if ip.To4() == nil {
+				addr = "[" + addr + "]"
+			}
+			var ipDests []string
+			for _, raddr := range hostDests {
+				dest := addr
+				if _, port, err := net.SplitHostPort(raddr); err == nil {
+					dest = net.JoinHostPort(ip.String(), port)
+				}
+				ipDests = append(ipDests, dest)
+				names[dest] = host
+			}
+			resolved = append(resolved, ipDests)
+		}
+	}
+	return resolved, names
+}
+
+// Largest CIDR block we'll expand, in host bits, so a typo doesn't start a few million tests
+const MaxCIDRBits = 12
+
+// Every address in a CIDR block, IPv6 ones in brackets. IPv4 network and broadcast addresses are left out.
+func expandCIDR(cidr string) ([]string, error) {
+	_, block, err := net.ParseCIDR(strings.Trim(cidr, "[]"))
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := block.Mask.Size()
+	if bits-ones > MaxCIDRBits {
+		return nil, fmt.Errorf("%s is more than %d addresses", cidr, 1<<MaxCIDRBits)
+	}
+	var addrs []string
+	for ip := block.IP; block.Contains(ip); ip = nextIP(ip) {
+		if bits == 128 {
+			addrs = append(addrs, "["+ip.String()+"]")
+		} else {
+			addrs = append(addrs, ip.String())
+		}
+	}
+	if bits == 32 && ones < 31 {
+		addrs = addrs[1 : len(addrs)-1]
+	}
+	return addrs, nil
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
 // Find the range of ports on the destination, if any. Returns 0,0 for error which should work fine (will error out on non-IP or ICMP protos)
 // port range is inclusive -- we need to test the start and the end
 func findDestRange(IPPort string) (IP string, startPort, endPort int) {
@@ -370,66 +802,235 @@ func runTest(test *Test, p *ICMPPublisher) {
 	debug.Println("Running test", fmtTest(*test))
 
 	test.run = true
+	test.start = time.Now()
 	allPassed := true
 	var errorText string
 
-	i := strings.LastIndex(test.net, ":")
-	var afnet string
-	if i < 0 { // no colon
-		afnet = test.net
-	} else {
-		afnet = test.net[:i]
-	}
-	debug.Println("Got type of", afnet)
 	for subTestV := test.subTests.Front(); subTestV != nil; subTestV = subTestV.Next() {
 		subTest := subTestV.Value.(*SubTest)
+		afnet := subTest.net // the subTests of a dual test each have their own family
+		if i := strings.LastIndex(afnet, ":"); i >= 0 {
+			afnet = afnet[:i]
+		}
+		debug.Println("Got type of", afnet)
+		var probe func(string, *SubTest, *ICMPPublisher)
 		switch afnet {
-		//case "ip", "ip4", "ip6":
+		case "ip", "ip4", "ip6":
+			if !isICMP(subTest.net) {
+				allPassed = false
+				errorText = "Protocol " + test.net + " not yet implemented"
+				continue
+			}
+			probe = runICMPTest
 		case "udp", "udp4", "udp6":
-			runUDPTest(afnet, subTest, p)
+			probe = runUDPTest
 		case "tcp", "tcp4", "tcp6":
-			runTCPTest(afnet, subTest, p)
+			probe = runTCPTest
+		case "dns", "dns4", "dns6", "dns+tcp", "dns+tcp4", "dns+tcp6":
+			probe = runDNSTest
+		case "ntp", "ntp4", "ntp6":
+			probe = runNTPTest
+		case "tls", "tls4", "tls6":
+			probe = runTLSTest
+		case "http", "http4", "http6", "https", "https4", "https6":
+			probe = runHTTPTest
+		case "sctp", "sctp4", "sctp6":
+			probe = runSCTPTest
+		case "pmtu", "pmtu4", "pmtu6":
+			probe = runPMTUTest
 		default:
-			// Do ICMP tests since Dial doesn't support them
 			allPassed = false
-			errorText = "Protocol" + afnet + " not yet implemented"
+			errorText = "Protocol " + afnet + " not yet implemented"
+			continue
+		}
+		retryProbe(probe, afnet, subTest, p)
+		if test.opts.expect != ExpectAllow {
+			checkExpectation(subTest, test.opts.expect)
+		} else if !subTest.passed && !subTest.refused && subTest.state != StateAnswered && wantTraceroute(afnet, test.opts) {
+			subTest.error = strings.TrimSpace(subTest.error + " " + traceroute(afnet, subTest, p))
+		}
+	}
+
+	var passed bool
+	var failures string
+	if test.dual {
+		passed, test.asymmetric, failures = dualPassed(test)
+	} else {
+		passed, failures = subTestsPassed(test)
+	}
+	allPassed = allPassed && passed
+	if !allPassed {
+		errorText += failures
+	}
+	test.passed = allPassed
+	test.error = errorText
+	test.elapsed = time.Since(test.start)
+
+	return
+}
+
+// Run a subTest's probe, then again up to the test's retries times while it fails. Refusals and ICMP errors are
+// definite answers, so they aren't retried; silence, timeouts and bad replies might not happen the next time, unless
+// the test expects the flow to be dropped, when silence is the answer.
+func retryProbe(probe func(string, *SubTest, *ICMPPublisher), afnet string, test *SubTest, p *ICMPPublisher) {
+	for {
+		test.attempts++
+		probe(afnet, test, p)
+		if test.passed || test.refused || test.state == StateRejected || expectationMet(test.state, test.opts.expect) ||
+			test.attempts > test.opts.retries {
+			return
 		}
+		delay := retryDelay(test.opts.backoff, test.attempts)
+		debug.Printf("Attempt %d failed, retrying in %s: %s", test.attempts, delay, fmtSubTest(*test))
+		time.Sleep(delay)
+		test.reset()
 	}
+}
 
-	// Rules for test passing.
-	// If there is only one test, then it must connect.
-	// If there is a range, then 1->all of them must connect, but some are allowed to be refused
-	// If there is a range and any fail for another reason, then the test fails.
+// How long to wait before retry n: the backoff doubled for each retry before it, then anywhere from half of that to
+// all of it, so that tests which failed together don't all retry together
+func retryDelay(backoff time.Duration, n int) time.Duration {
+	delay := backoff
+	for i := 1; i < n && delay < MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > MaxRetryDelay {
+		delay = MaxRetryDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Forget what a failed attempt found, before it's retried
+func (test *SubTest) reset() {
+	test.laddr_used, test.raddr_used = "", ""
+	test.run, test.passed, test.refused = false, false, false
+	test.rtt = 0
+	test.state, test.info, test.error = "", "", ""
+}
+
+// Forget a run's results, before the test is run again
+func (test *Test) reset() {
+	test.run, test.passed, test.asymmetric = false, false, false
+	test.error = ""
+	test.start, test.elapsed = time.Time{}, 0
+	for subTestV := test.subTests.Front(); subTestV != nil; subTestV = subTestV.Next() {
+		subTest := subTestV.Value.(*SubTest)
+		subTest.reset()
+		subTest.attempts = 0
+	}
+}
+
+// Rules for test passing.
+// Tests that expect the flow to be blocked have already had their subTests' results inverted, so the same rules apply.
+// If there is only one test, then it must connect (or not, for pass=none).
+// If there is a range (or any other expanded destination), then what has to connect is up to the pass option:
+// by default 1->all of them must connect, but some are allowed to be refused, and if any fail for another reason,
+// then the test fails. any needs one to connect, all needs every one to, quorum needs more than half, a number
+// needs at least that many and none needs none of them to. With refusedok a refused subTest counts as connecting.
+// Returns the reasons of the subTests that count against the test.
+func subTestsPassed(test *Test) (bool, string) {
+	policy := test.opts.policy
 	listLen := test.subTests.Len()
-	onePass := false
+	passed := 0
+	var failures string
 	for subTestV := test.subTests.Front(); subTestV != nil; subTestV = subTestV.Next() {
 		subTest := subTestV.Value.(*SubTest)
-		// record if one test passed
-		if subTest.passed && !onePass {
-			onePass = true
+		ok := subTest.passed || (policy.refusedOK && subTest.refused)
+		if ok {
+			passed++
 		}
-		if !subTest.passed && listLen == 1 {
-			allPassed = false
-			errorText = subTest.error
+		var reason string
+		switch {
+		case policy.rule == PassNone && ok:
+			reason = "connected"
+			if subTest.refused {
+				reason = "refused"
+			}
+		case policy.rule == PassNone, ok:
+			continue
+		case policy.rule == PassRange && subTest.refused && listLen > 1:
+			continue
+		default:
+			reason = subTestReason(subTest)
 		}
+		debug.Printf("subTest %+v", *subTest)
+		if listLen == 1 {
+			failures = reason
+		} else {
+			failures += fmt.Sprintf("%s %s;", subTest.subref, reason)
+		}
+	}
 
-		if listLen > 1 && !subTest.passed && !subTest.refused {
-			debug.Printf("subTest %+v", *subTest)
-			errorText += fmt.Sprintf("%s %s;", subTest.subref, subTest.error)
-			if allPassed {
-				allPassed = false
-			}
+	var needed int
+	switch policy.rule {
+	case PassAny:
+		needed = 1
+	case PassAll:
+		needed = listLen
+	case PassQuorum:
+		needed = listLen/2 + 1
+	case PassAtLeast:
+		needed = policy.atLeast
+	case PassNone:
+		return passed == 0, failures
+	default:
+		if passed > 0 && failures == "" {
+			return true, ""
 		}
+		if listLen > 1 && passed == 0 {
+			failures = "all refused;" + failures
+		}
+		return false, failures
+	}
+	if passed >= needed {
+		return true, ""
+	}
+	if listLen == 1 {
+		return false, failures
 	}
+	return false, fmt.Sprintf("%d of %d passed, pass=%s needs %d: %s", passed, listLen, policy, needed, failures)
+}
 
-	// Cater for the case where all ports were refused
-	if allPassed && !onePass {
-		allPassed = false
+// A dual test has to pass over IPv4 and IPv6 separately, by the usual rules. Passing over only one of them is
+// reported as asymmetric: that's usually a firewall rule, route or listener that was only set up for one family,
+// rather than the service being down.
+func dualPassed(test *Test) (passed, asymmetric bool, failures string) {
+	v4 := Test{ref: test.ref, opts: test.opts}
+	v6 := Test{ref: test.ref, opts: test.opts}
+	for subTestV := test.subTests.Front(); subTestV != nil; subTestV = subTestV.Next() {
+		subTest := subTestV.Value.(*SubTest)
+		if subTest.ipv6 {
+			v6.subTests.PushBack(subTest)
+		} else {
+			v4.subTests.PushBack(subTest)
+		}
 	}
-	test.passed = allPassed
-	test.error = errorText
+	v4Passed, v4Failures := subTestsPassed(&v4)
+	v6Passed, v6Failures := subTestsPassed(&v6)
+	switch {
+	case v4Passed && v6Passed:
+		return true, false, ""
+	case v4Passed:
+		return false, true, "IPv4 passed but IPv6 failed: " + v6Failures
+	case v6Passed:
+		return false, true, "IPv6 passed but IPv4 failed: " + v4Failures
+	}
+	return false, false, "IPv4 failed: " + v4Failures + " IPv6 failed: " + v6Failures
+}
 
-	return
+// Why a subTest didn't pass, for the error text
+func subTestReason(test *SubTest) string {
+	switch {
+	case test.error != "":
+		return test.error
+	case test.refused:
+		return "refused"
+	case test.state != "":
+		return test.state
+	case !test.run:
+		return "not run"
+	}
+	return "failed"
 }
 
 func runUDPTest(afnet string, test *SubTest, p *ICMPPublisher) {
@@ -451,29 +1052,32 @@ func runUDPTest(afnet string, test *SubTest, p *ICMPPublisher) {
 		return
 	}
 
-	d.Timeout, err = time.ParseDuration(*params.Timeout)
+	d.Timeout = testTimeout(test.opts)
 	conn, err := d.Dial(test.net, test.raddr)
 	if err != nil {
 		test.run = true
 		test.error = "UDP Dial error: " + err.Error()
 		return
 	}
+	defer conn.Close()
 	test.laddr_used = conn.LocalAddr().String()
 	test.raddr_used = conn.RemoteAddr().String()
-	_, err = conn.Write([]byte("conchk test packet")) // hard to fail for UDP, the ICMP response is the important thing
+	// get the kernel to tell us about any ICMP errors for this socket too, since without root that's all we'll see
+	if err = enableRecvErr(conn.(*net.UDPConn)); err != nil {
+		debug.Println("Cannot enable ICMP error reporting on the socket:", err)
+	}
+	payload := []byte("conchk test packet")
+	if test.opts.payload != nil {
+		payload = test.opts.payload
+	}
+	_, err = conn.Write(payload) // hard to fail for UDP, the reply or ICMP response is the important thing
 	if err != nil {
 		test.run = true
 		test.error = "UDP Write error: " + err.Error()
 		return
 	}
-	conn.Close()
 
-	if gotRoot && waitForPossibleICMP(test, icmpCh) {
-		debug.Println("Failed due to ICMP response")
-	} else {
-		test.run = true
-		test.passed = true
-	}
+	waitForUDPReply(test, conn.(*net.UDPConn), icmpCh)
 	debug.Println("*****Completed: ", fmtSubTest(*test))
 }
 
@@ -490,25 +1094,25 @@ func runTCPTest(afnet string, test *SubTest, p *ICMPPublisher) {
 		test.error = "TCP Resolve error: " + err.Error()
 		return
 	}
-	d.Timeout, err = time.ParseDuration(*params.Timeout)
-	if err != nil {
-		test.run = true
-		test.error = "Invalid timeout value specified: " + err.Error()
-		return
-	}
+	d.Timeout = testTimeout(test.opts)
+	start := time.Now()
 	conn, err := d.Dial(test.net, test.raddr)
-	if nerr, ok := err.(*net.OpError); ok && nerr.Err.Error() == "connection refused" {
+	if isConnRefused(err) {
 		test.run = true
+		test.state = StateRejected
 		test.refused = true
-		debug.Printf("Got TCP conn refused %v....%+v", nerr, *nerr)
+		debug.Printf("Got TCP conn refused %v....%+v", err, err)
 		return
 	}
 	if err != nil {
 		debug.Printf("Error was type %T, %+v", err, err)
 		test.run = true
+		test.state = connectErrorState(err)
 		test.error = "Connect error: " + err.Error()
 		return
 	}
+	test.rtt = time.Since(start)
+	test.state = StateAnswered
 	test.laddr_used = conn.LocalAddr().String()
 	test.raddr_used = conn.RemoteAddr().String()
 	_, err = conn.Write([]byte("conchk test packet"))
@@ -523,6 +1127,152 @@ func runTCPTest(afnet string, test *SubTest, p *ICMPPublisher) {
 	debug.Println(fmtSubTest(*test))
 }
 
+// Traceroute a failed test if it's on for this test, or on globally and not off for this test
+func wantTraceroute(afnet string, opts *TestOptions) bool {
+	switch afnet {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+	default:
+		return false
+	}
+	if opts.traceroute != nil {
+		return *opts.traceroute
+	}
+	return params.Traceroute != nil && *params.Traceroute
+}
+
+// The address family suffix of a protocol, e.g. "4" for tcp4 and "" for tcp
+func familySuffix(afnet string) string {
+	if strings.HasSuffix(afnet, "4") || strings.HasSuffix(afnet, "6") {
+		return afnet[len(afnet)-1:]
+	}
+	return ""
+}
+
+// The test's timeout, or --timeout if it doesn't have one
+func testTimeout(opts *TestOptions) time.Duration {
+	if opts != nil && opts.timeout > 0 {
+		return opts.timeout
+	}
+	return Timeout
+}
+
+// Does the protocol have IPv4 and IPv6 variants, e.g. tcp4 and tcp6, for a dual test to run
+func hasFamilies(proto string) bool {
+	switch proto {
+	case "tcp", "udp", "sctp", "dns", "dns+tcp", "ntp", "tls", "http", "https", "pmtu":
+		return true
+	}
+	return false
+}
+
+// A plain UDP test without response= is silent whether the flow is open or dropped, so it can't tell the two apart
+// and expect=deny or drop would always pass
+func checkExpectOption(proto string, opts *TestOptions) error {
+	switch strings.TrimSuffix(proto, DualSuffix) {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil
+	}
+	if (opts.expect == ExpectDeny || opts.expect == ExpectDrop) && opts.response == nil {
+		return fmt.Errorf("expect=%s on a udp test needs response=, or an open flow looks the same as a dropped one", opts.expect)
+	}
+	return nil
+}
+
+// For a test that expects the flow to be blocked, the probe connecting is the failure. The way it was blocked can
+// matter too: a reject (RST or ICMP error) is not a drop (silence).
+func checkExpectation(test *SubTest, expect string) {
+	if expectationMet(test.state, expect) {
+		test.passed = true
+		test.refused = false
+		test.info = strings.TrimSpace(test.state + " as expected. " + test.error)
+		test.error = ""
+		return
+	}
+
+	state := test.state
+	if state == "" {
+		state = "an error"
+	}
+	test.passed = false
+	test.refused = false
+	test.error = strings.TrimSpace(fmt.Sprintf("Expected %s but got %s. %s", expect, state, test.error))
+}
+
+// Is a probe's outcome what a test that expects the flow to be blocked wants
+func expectationMet(state, expect string) bool {
+	switch expect {
+	case ExpectDeny:
+		return state == StateRejected || state == StateSilent
+	case ExpectReject:
+		return state == StateRejected
+	case ExpectDrop:
+		return state == StateSilent
+	}
+	return false
+}
+
+// Dial for the application level probes, from the test's local address and with the usual timeout
+func dialSubTest(network string, test *SubTest) (net.Conn, error) {
+	var d net.Dialer
+	var err error
+
+	d.Timeout = testTimeout(test.opts)
+	if strings.HasPrefix(network, "udp") {
+		d.LocalAddr, err = net.ResolveUDPAddr(network, test.laddr)
+	} else {
+		d.LocalAddr, err = net.ResolveTCPAddr(network, test.laddr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.Dial(network, test.raddr)
+	if err != nil {
+		return nil, err
+	}
+	test.laddr_used = conn.LocalAddr().String()
+	test.raddr_used = conn.RemoteAddr().String()
+	return conn, nil
+}
+
+// Record why the exchange for a UDP based probe failed: silence, or the ICMP error the socket was told about
+func recordUDPError(test *SubTest, conn *net.UDPConn, err error, proto string) {
+	test.run = true
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		test.state = StateSilent
+		test.error = proto + " error: " + err.Error()
+		return
+	}
+	test.state = StateRejected
+	if msg, qerr := readErrQueue(conn); qerr == nil {
+		test.refused = msg.unreachable()
+		test.error = proto + " " + msg.desc
+		return
+	}
+	test.refused = isConnRefused(err)
+	test.error = proto + " error: " + err.Error()
+}
+
+// The remote host as named in the test, even once resolve=all has replaced it with one of its addresses
+func (test *SubTest) remoteName() string {
+	if test.rname != "" {
+		return test.rname
+	}
+	host, _, err := net.SplitHostPort(test.raddr)
+	if err != nil {
+		host = test.raddr
+	}
+	return strings.Trim(host, "[]")
+}
+
+// Add the service's well known port if the test doesn't give one
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+	}
+	return addr
+}
+
 // acquire n resources
 func (s semaphore) acquire(n int) {
 	e := empty{}
@@ -549,9 +1299,24 @@ func fmtTest(test Test) string {
 	status := testResult(test)
 
 	out := fmt.Sprintf("%s: %s '%s' %s %s --> %s", status, pad(test.ref, 5), pad(test.desc, 60), test.net, local, test.raddr)
+	if test.opts != nil && test.opts.expect != ExpectAllow {
+		out += " [expect " + test.opts.expect + "]"
+	}
 	if test.ipv6 {
 		out += " [on AF_INET6 socket]"
 	}
+	if test.dual {
+		out += " [IPv4 and IPv6]"
+	}
+	if rtt := testRTT(test); rtt > 0 {
+		out += " RTT: " + rtt.String()
+	}
+	if attempts := testAttempts(test); attempts > 1 {
+		out += fmt.Sprintf(" ATTEMPTS: %d", attempts)
+	}
+	if info := testInfo(test); len(info) > 0 {
+		out += " INFO: " + info
+	}
 	if len(test.error) > 0 {
 		out += " ERROR INFO: " + test.error
 	}
@@ -563,19 +1328,108 @@ func fmtSubTest(test SubTest) string {
 	// only print the addresses actually used, since the parent Test will print the requested values
 	status := subTestResult(test)
 
-	out := fmt.Sprintf("%s %s --> %s %s", pad(test.subref, 6), test.laddr_used, test.raddr_used, status)
+	raddr := test.raddr_used
+	if raddr == "" { // didn't get as far as connecting, but which address it was still matters
+		raddr = test.raddr
+	}
+	out := fmt.Sprintf("%s %s --> %s %s", pad(test.subref, 6), test.laddr_used, raddr, status)
+	if test.state != "" {
+		out += " (" + test.state + ")"
+	}
+	if test.rtt > 0 {
+		out += " RTT: " + test.rtt.String()
+	}
+	if test.attempts > 1 {
+		out += fmt.Sprintf(" after %d attempts", test.attempts)
+	}
+	if len(test.info) > 0 {
+		out += " INFO: " + test.info
+	}
 	if len(test.error) > 0 {
 		out += " ERROR INFO: " + test.error
 	}
 	return out
 }
 
+// Every subtest's address and result, for when they are worth reporting individually
+func subTestResults(test Test) string {
+	var results []string
+	for subTestV := test.subTests.Front(); subTestV != nil; subTestV = subTestV.Next() {
+		subTest := subTestV.Value.(*SubTest)
+		results = append(results, strings.TrimSpace(fmt.Sprintf("%s %s %s", subTest.subref, subTest.raddr, subTestResult(*subTest))))
+	}
+	return strings.Join(results, ";")
+}
+
+// A subtest's address and how it went, on one line
+func subTestSummary(test SubTest) string {
+	raddr := test.raddr_used
+	if raddr == "" {
+		raddr = test.raddr
+	}
+	out := raddr + " " + subTestResult(test)
+	if test.state != "" {
+		out += " (" + test.state + ")"
+	}
+	if test.error != "" {
+		out += " " + test.error
+	}
+	return out
+}
+
+// Average round trip time over the subtests that recorded one, or 0 if none did
+func testRTT(test Test) time.Duration {
+	var total time.Duration
+	var count int64
+	for subTestV := test.subTests.Front(); subTestV != nil; subTestV = subTestV.Next() {
+		subTest := subTestV.Value.(*SubTest)
+		if subTest.rtt > 0 {
+			total += subTest.rtt
+			count++
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	return total / time.Duration(count)
+}
+
+// The most attempts any of the subtests took
+func testAttempts(test Test) int {
+	var attempts int
+	for subTestV := test.subTests.Front(); subTestV != nil; subTestV = subTestV.Next() {
+		subTest := subTestV.Value.(*SubTest)
+		if subTest.attempts > attempts {
+			attempts = subTest.attempts
+		}
+	}
+	return attempts
+}
+
+// What the subtests found out, labelled by subref when there is more than one
+func testInfo(test Test) string {
+	var info string
+	for subTestV := test.subTests.Front(); subTestV != nil; subTestV = subTestV.Next() {
+		subTest := subTestV.Value.(*SubTest)
+		if len(subTest.info) == 0 {
+			continue
+		}
+		if len(subTest.subref) > 0 {
+			info += subTest.subref + " "
+		}
+		info += subTest.info + ";"
+	}
+	return strings.TrimSuffix(info, ";")
+}
+
 func testResult(test Test) string {
 	status := "PENDING"
 	if test.run {
 		status = "FAILED"
 		if test.passed {
 			status = "PASSED"
+		} else if test.asymmetric {
+			status = "ASYMMETRIC"
 		}
 	}
 	return status
@@ -595,7 +1449,7 @@ func subTestResult(test SubTest) string {
 func fmtTestCSV(test Test) []string {
 	const fields int = 11
 
-	out := make([]string, fields)
+	out := make([]string, fields, fields+len(test.opts.raw))
 
 	out = out[0:fields]
 	out[0] = test.ref
@@ -609,6 +1463,13 @@ func fmtTestCSV(test Test) []string {
 	out[8] = test.net
 	out[9] = testResult(test)
 	out[10] = test.error
+	if test.opts.resolveAll || test.dual {
+		out[10] = strings.TrimSpace(test.error + " " + subTestResults(test))
+	}
+	if test.opts.retries > 0 && test.run {
+		out[10] = strings.TrimSpace(fmt.Sprintf("%s attempts: %d", out[10], testAttempts(test)))
+	}
+	out = append(out, test.opts.raw...)
 
 	debug.Printf("CSV line is %v", out)
 	return out
@@ -621,11 +1482,26 @@ func pad(s string, length int) string {
 	return s
 }
 
-// Huge assumption that IPv6 addresses will always be in square brackets. Lets run with this for now
-// TODO(bf) Verify this, or validate it on config read at least
-func isV6(ip string) bool {
-	if strings.LastIndex(ip, "[") < 0 {
+// Is this an ICMP protocol spec, e.g. ip4:icmp or ip4:1
+func isICMP(net string) bool {
+	i := strings.LastIndex(net, ":")
+	if i < 0 {
 		return false
 	}
-	return true
+	switch strings.ToLower(net[i+1:]) {
+	case "icmp", "1", "ipv6-icmp", "58":
+		return true
+	}
+	return false
+}
+
+// Is the address an IPv6 one, with or without a port. Host names aren't, as either family could be used for them.
+// Bracketed addresses always are, even IPv4-mapped ones, since they need an AF_INET6 socket.
+func isV6(ip string) bool {
+	host, _, err := net.SplitHostPort(ip)
+	if err != nil {
+		host = ip
+	}
+	host = strings.Trim(host, "[]")
+	return net.ParseIP(host) != nil && strings.Contains(host, ":")
 }
@@ -21,21 +21,23 @@
 package main
 
 import (
+	"fmt"
+	"strings"
 	"testing"
-	"container/list"
+	"time"
 )
 
 var defaultTests = []Test{
-	{"1", "ICMPv4 localhost", "lhost", "", "lhost_desc", "rhost", "127.0.0.1", "rhost_desc", "ip4:icmp", false, false, false, false, "", list.List{}},
-	{"2", "ICMPv6 localhost", "lhost", "", "lhost_desc", "rhost", "[::1]", "rhost_desc", "ip4:icmp", false, false, false, false, "", list.List{}},
-	{"3", "UDP localhost:80", "lhost", "localhost:1025", "lhost_desc", "rhost", "127.0.0.1:80", "rhost_desc", "udp4", false, false, false, false, "", list.List{}},
-	{"4", "TCP localhost:http", "lhost", "", "lhost_desc", "rhost", "127.0.0.1:80", "rhost_desc", "tcp4", false, false, false, false, "", list.List{}},
-	{"4", "TCP bad.example.com:http", "lhost", "", "lhost_desc", "rhost", "bad.example.com:http", "rhost_desc", "tcp4", false, false, false, false, "", list.List{}},
+	{ref: "1", desc: "ICMPv4 localhost", lhost: "lhost", laddr: "", ldesc: "lhost_desc", rhost: "rhost", raddr: "127.0.0.1", rdesc: "rhost_desc", net: "ip4:icmp"},
+	{ref: "2", desc: "ICMPv6 localhost", lhost: "lhost", laddr: "", ldesc: "lhost_desc", rhost: "rhost", raddr: "[::1]", rdesc: "rhost_desc", net: "ip4:icmp"},
+	{ref: "3", desc: "UDP localhost:80", lhost: "lhost", laddr: "localhost:1025", ldesc: "lhost_desc", rhost: "rhost", raddr: "127.0.0.1:80", rdesc: "rhost_desc", net: "udp4"},
+	{ref: "4", desc: "TCP localhost:http", lhost: "lhost", laddr: "", ldesc: "lhost_desc", rhost: "rhost", raddr: "127.0.0.1:80", rdesc: "rhost_desc", net: "tcp4"},
+	{ref: "4", desc: "TCP bad.example.com:http", lhost: "lhost", laddr: "", ldesc: "lhost_desc", rhost: "rhost", raddr: "bad.example.com:http", rdesc: "rhost_desc", net: "tcp4"},
 }
 
 func TestIsV6(t *testing.T) {
-	var v4 = []string{"1.1.1.1", "10.10.10.10", "255.255.255.255", "1.0.255.254", "0.0.0.0", "1.1.1.1:1", "23.12.167.1:65535"}
-	var v6 = []string{"[::1]", "[FE80:0000:0000:0000:0202:B3FF:FE1E:8329]", "[fdf8:f53b:82e4::53]", "[::ffff:192.0.2.47]", "[2001:db8:8:4::2]"}
+	var v4 = []string{"1.1.1.1", "10.10.10.10", "255.255.255.255", "1.0.255.254", "0.0.0.0", "1.1.1.1:1", "23.12.167.1:65535", "example.com:80", "[example.com]:80"}
+	var v6 = []string{"[::1]", "[FE80:0000:0000:0000:0202:B3FF:FE1E:8329]", "[fdf8:f53b:82e4::53]", "[::ffff:192.0.2.47]", "[2001:db8:8:4::2]", "[::1]:443", "fdf8:f53b:82e4::53"}
 
 	for _, ip := range v4 {
 		result := isV6(ip)
@@ -75,3 +77,310 @@ func TestFindDestRange(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckExpectation(t *testing.T) {
+	var tests = []struct {
+		Expect string
+		State  string
+		Passed bool
+	}{
+		{ExpectDeny, StateRejected, true},
+		{ExpectDeny, StateSilent, true},
+		{ExpectDeny, StateAnswered, false},
+		{ExpectDeny, "", false},
+		{ExpectReject, StateRejected, true},
+		{ExpectReject, StateSilent, false},
+		{ExpectDrop, StateSilent, true},
+		{ExpectDrop, StateRejected, false},
+	}
+	for count, test := range tests {
+		subTest := SubTest{run: true, state: test.State, refused: test.State == StateRejected, passed: test.State == StateAnswered}
+		checkExpectation(&subTest, test.Expect)
+		if subTest.passed != test.Passed || subTest.refused {
+			t.Fatalf("Line %d expect %s with %s should have passed=%v: %+v", count+1, test.Expect, test.State, test.Passed, subTest)
+		}
+	}
+}
+
+func TestExpandDest(t *testing.T) {
+	var tests = []struct {
+		Dest  string
+		Hosts int
+		Dests string // hosts separated by |, each host's destinations by spaces. Not checked if empty
+		Err   bool
+	}{
+		{"10.0.0.1:80", 1, "10.0.0.1:80", false},
+		{"10.0.0.1:80-82", 1, "10.0.0.1:80 10.0.0.1:81 10.0.0.1:82", false},
+		{"10.0.0.1", 1, "10.0.0.1", false},
+		{"[::1]", 1, "[::1]", false},
+		{"bad.example.com:http", 1, "bad.example.com:http", false},
+		{"10.0.0.1:80,443,8000-8001", 1, "10.0.0.1:80 10.0.0.1:443 10.0.0.1:8000 10.0.0.1:8001", false},
+		{"web1, [2001:db8::1]:443", 2, "web1:443|[2001:db8::1]:443", false},
+		{"10.1.2.0/30:22", 2, "10.1.2.1:22|10.1.2.2:22", false},
+		{"10.1.2.4/31", 2, "10.1.2.4|10.1.2.5", false},
+		{"[2001:db8::/127]:53", 2, "[2001:db8::]:53|[2001:db8::1]:53", false},
+		{"10.1.2.0/28,10.1.3.1:80", 15, "", false},
+		{"10.0.0.0/8:80", 0, "", true},
+		{"10.1.2.0/33:80", 0, "", true},
+	}
+	for count, test := range tests {
+		dests, err := expandDest(test.Dest)
+		if (err != nil) != test.Err || len(dests) != test.Hosts {
+			t.Fatalf("Line %d expanding %s should be %d hosts and failed=%v, got %d: %v", count+1, test.Dest, test.Hosts, test.Err, len(dests), err)
+		}
+		var got []string
+		for _, hostDests := range dests {
+			got = append(got, strings.Join(hostDests, " "))
+		}
+		if test.Dests != "" && strings.Join(got, "|") != test.Dests {
+			t.Fatalf("Line %d %s expanded to %q, wanted %q", count+1, test.Dest, got, test.Dests)
+		}
+	}
+}
+
+func TestSubTestsPassed(t *testing.T) {
+	var tests = []struct {
+		Pass    string
+		Results string // P passed, R refused, F failed, one per subTest
+		Passed  bool
+		Error   string
+	}{
+		{"range", "P", true, ""},
+		{"range", "R", false, "refused"},
+		{"range", "F", false, "F"},
+		{"range", "PRR", true, ""},
+		{"range", "RRR", false, "all refused;"},
+		{"range", "PPF", false, "1.3 F;"},
+		{"any", "PFF", true, ""},
+		{"any", "RFF", false, "0 of 3 passed, pass=any needs 1: 1.1 refused;1.2 F;1.3 F;"},
+		{"all", "PPP", true, ""},
+		{"all", "PPR", false, "2 of 3 passed, pass=all needs 3: 1.3 refused;"},
+		{"quorum", "PPF", true, ""},
+		{"quorum", "PPFF", false, "2 of 4 passed, pass=quorum needs 3: 1.3 F;1.4 F;"},
+		{"quorum", "F", false, "F"},
+		{"2", "PFPF", true, ""},
+		{"3", "PFPF", false, "2 of 4 passed, pass=3 needs 3: 1.2 F;1.4 F;"},
+		{"none", "FRF", true, ""},
+		{"none", "FPF", false, "1.2 connected;"},
+		{"none", "P", false, "connected"},
+		{"all,refusedok", "PRP", true, ""},
+		{"all,refusedok", "PRF", false, "2 of 3 passed, pass=all, refusedok needs 3: 1.3 F;"},
+		{"range,refusedok", "RRR", true, ""},
+		{"none,refusedok", "FRF", false, "1.2 refused;"},
+	}
+	for count, test := range tests {
+		var tt Test
+		var err error
+		rule := strings.Split(test.Pass, ",")
+		tt.opts = &TestOptions{}
+		if tt.opts.policy, err = parsePassRule(rule[0]); err != nil {
+			t.Fatalf("Line %d failed to parse pass=%s: %v", count+1, rule[0], err)
+		}
+		tt.opts.policy.refusedOK = len(rule) > 1
+		for i, r := range test.Results {
+			subTest := &SubTest{subref: fmt.Sprintf("1.%d", i+1), run: true, passed: r == 'P', refused: r == 'R'}
+			if r == 'F' {
+				subTest.error = "F"
+			}
+			tt.subTests.PushBack(subTest)
+		}
+		if passed, failures := subTestsPassed(&tt); passed != test.Passed || failures != test.Error {
+			t.Fatalf("Line %d pass=%s with %s should have passed=%v %q, got %v %q", count+1, test.Pass, test.Results, test.Passed, test.Error, passed, failures)
+		}
+	}
+}
+
+func TestResolveDests(t *testing.T) {
+	dests, names := resolveDests([][]string{{"localhost:80", "localhost:443"}, {"10.0.0.1:80"}}, "4")
+	if len(dests) != 2 || strings.Join(dests[0], " ") != "127.0.0.1:80 127.0.0.1:443" || dests[1][0] != "10.0.0.1:80" {
+		t.Fatalf("Destinations resolved incorrectly: %q", dests)
+	}
+	if names["127.0.0.1:443"] != "localhost" || names["10.0.0.1:80"] != "" {
+		t.Fatalf("Names recorded incorrectly: %q", names)
+	}
+	subTest := SubTest{raddr: "127.0.0.1:443", rname: names["127.0.0.1:443"]}
+	if subTest.remoteName() != "localhost" {
+		t.Fatal("Resolved subtest lost its name:", subTest.remoteName())
+	}
+	subTest = SubTest{raddr: "[::1]:443"}
+	if subTest.remoteName() != "::1" {
+		t.Fatal("Remote name of an address is wrong:", subTest.remoteName())
+	}
+
+	opts, err := parseTestOptions([]string{"resolve=all"})
+	if err != nil || !opts.resolveAll || opts.policy.rule != PassAll {
+		t.Fatalf("resolve=all should default to pass=all: %+v %v", opts, err)
+	}
+	if opts, err = parseTestOptions([]string{"resolve=all", "pass=any"}); err != nil || opts.policy.rule != PassAny {
+		t.Fatalf("resolve=all should keep a given pass: %+v %v", opts, err)
+	}
+
+	// --listen builds the subtests again before each run, which has to replace the last run's
+	test := Test{ref: "1", net: "tcp4", raddr: "localhost:443", attempt: true, opts: opts}
+	for run := 1; run <= 2; run++ {
+		test.buildSubTests()
+		if test.subTests.Len() != 1 {
+			t.Fatalf("Run %d has %d subtests for localhost", run, test.subTests.Len())
+		}
+		if subTest := test.subTests.Front().Value.(*SubTest); subTest.raddr != "127.0.0.1:443" || subTest.rname != "localhost" {
+			t.Fatalf("Run %d resolved localhost incorrectly: %s", run, fmtSubTest(*subTest))
+		}
+	}
+}
+
+func TestDualPassed(t *testing.T) {
+	var tests = []struct {
+		Pass       string
+		V4, V6     string // P passed, R refused, F failed, one per subTest
+		Passed     bool
+		Asymmetric bool
+		Error      string
+	}{
+		{"range", "P", "P", true, false, ""},
+		{"range", "P", "F", false, true, "IPv4 passed but IPv6 failed: F"},
+		{"range", "R", "P", false, true, "IPv6 passed but IPv4 failed: refused"},
+		{"range", "F", "F", false, false, "IPv4 failed: F IPv6 failed: F"},
+		{"range", "PR", "RR", false, true, "IPv4 passed but IPv6 failed: all refused;"},
+		{"any", "FP", "PF", true, false, ""},
+		{"none", "F", "P", false, true, "IPv4 passed but IPv6 failed: connected"},
+	}
+	for count, test := range tests {
+		var tt Test
+		var err error
+		tt.opts = &TestOptions{}
+		if tt.opts.policy, err = parsePassRule(test.Pass); err != nil {
+			t.Fatalf("Line %d failed to parse pass=%s: %v", count+1, test.Pass, err)
+		}
+		for family, results := range []string{test.V4, test.V6} {
+			for i, r := range results {
+				subTest := &SubTest{subref: fmt.Sprintf("1.%d.v%d", i+1, 4+family*2), ipv6: family == 1, run: true, passed: r == 'P', refused: r == 'R'}
+				if r == 'F' {
+					subTest.error = "F"
+				}
+				tt.subTests.PushBack(subTest)
+			}
+		}
+		passed, asymmetric, failures := dualPassed(&tt)
+		if passed != test.Passed || asymmetric != test.Asymmetric || failures != test.Error {
+			t.Fatalf("Line %d pass=%s with %s/%s should have passed=%v asymmetric=%v %q, got %v %v %q", count+1, test.Pass, test.V4, test.V6, test.Passed, test.Asymmetric, test.Error, passed, asymmetric, failures)
+		}
+	}
+}
+
+func TestRetryProbe(t *testing.T) {
+	var tests = []struct {
+		Retries  int
+		Results  string // what each attempt gets: P passed, R refused, S silent, F failed with a reply
+		Attempts int
+		Passed   bool
+	}{
+		{0, "S", 1, false},
+		{2, "P", 1, true},
+		{2, "SP", 2, true},
+		{2, "SSS", 3, false},
+		{2, "SSP", 3, true},
+		{1, "SSP", 2, false},
+		{3, "SR", 2, false},
+		{3, "FFP", 3, true},
+	}
+	for count, test := range tests {
+		subTest := &SubTest{opts: &TestOptions{retries: test.Retries}}
+		probe := func(afnet string, st *SubTest, p *ICMPPublisher) {
+			if st.run || st.error != "" {
+				t.Fatalf("Line %d attempt %d wasn't reset: %+v", count+1, st.attempts, *st)
+			}
+			st.run = true
+			switch test.Results[st.attempts-1] {
+			case 'P':
+				st.passed = true
+			case 'R':
+				st.refused, st.state = true, StateRejected
+			case 'S':
+				st.state, st.error = StateSilent, "timeout"
+			case 'F':
+				st.state, st.error = StateAnswered, "bad reply"
+			}
+		}
+		retryProbe(probe, "tcp", subTest, nil)
+		if subTest.attempts != test.Attempts || subTest.passed != test.Passed {
+			t.Fatalf("Line %d %s with retries=%d should have taken %d attempts and passed=%v, got %d %v", count+1, test.Results, test.Retries, test.Attempts, test.Passed, subTest.attempts, subTest.passed)
+		}
+	}
+
+	// silence is the answer a test expecting a drop wants, so there's nothing to retry
+	var expects = []struct {
+		Expect   string
+		Attempts int
+	}{
+		{ExpectDrop, 1},
+		{ExpectDeny, 1},
+		{ExpectReject, 3},
+	}
+	for count, test := range expects {
+		subTest := &SubTest{opts: &TestOptions{retries: 2, expect: test.Expect}}
+		probe := func(afnet string, st *SubTest, p *ICMPPublisher) {
+			st.run, st.state, st.error = true, StateSilent, "timeout"
+		}
+		retryProbe(probe, "udp", subTest, nil)
+		if subTest.attempts != test.Attempts {
+			t.Fatalf("Line %d silence with expect=%s should have taken %d attempts, got %d", count+1, test.Expect, test.Attempts, subTest.attempts)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	var tests = []struct {
+		Backoff  time.Duration
+		Retry    int
+		Min, Max time.Duration
+	}{
+		{0, 1, 0, 0},
+		{time.Second, 1, 500 * time.Millisecond, time.Second},
+		{time.Second, 3, 2 * time.Second, 4 * time.Second},
+		{time.Second, 20, MaxRetryDelay / 2, MaxRetryDelay},
+	}
+	for count, test := range tests {
+		for i := 0; i < 100; i++ {
+			if delay := retryDelay(test.Backoff, test.Retry); delay < test.Min || delay > test.Max {
+				t.Fatalf("Line %d retry %d with backoff %s waited %s, not %s to %s", count+1, test.Retry, test.Backoff, delay, test.Min, test.Max)
+			}
+		}
+	}
+}
+
+func TestTestTimeout(t *testing.T) {
+	defer func(saved time.Duration) { Timeout = saved }(Timeout)
+	Timeout = 3 * time.Second
+	if testTimeout(nil) != Timeout || testTimeout(&TestOptions{}) != Timeout {
+		t.Fatal("A test without a timeout should use --timeout")
+	}
+	if testTimeout(&TestOptions{timeout: 250 * time.Millisecond}) != 250*time.Millisecond {
+		t.Fatal("A test's timeout should override --timeout")
+	}
+}
+
+func TestCheckExpectOption(t *testing.T) {
+	var tests = []struct {
+		Proto   string
+		Options string
+		OK      bool
+	}{
+		{"udp4", "expect=deny", false},
+		{"udp", "expect=drop", false},
+		{"udp+dual", "expect=deny", false},
+		{"udp4", "expect=deny,response=any", true},
+		{"udp4", "expect=reject", true},
+		{"udp4", "expect=allow", true},
+		{"tcp4", "expect=drop", true},
+		{"dns4", "expect=deny", true},
+	}
+	for count, test := range tests {
+		opts, err := parseTestOptions(strings.Split(test.Options, ","))
+		if err != nil {
+			t.Fatalf("Line %d failed to parse %s: %v", count+1, test.Options, err)
+		}
+		if err = checkExpectOption(test.Proto, opts); (err == nil) != test.OK {
+			t.Fatalf("Line %d %s with %s should have been ok=%v, got %v", count+1, test.Proto, test.Options, test.OK, err)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DNS query types we know by name. Anything else can be given as a number.
+var DNSTypes map[string]uint16 = map[string]uint16{
+	"A":     1,
+	"NS":    2,
+	"CNAME": 5,
+	"SOA":   6,
+	"PTR":   12,
+	"MX":    15,
+	"TXT":   16,
+	"AAAA":  28,
+	"SRV":   33,
+	"ANY":   255,
+}
+
+var DNSRcodes map[int]string = map[int]string{
+	0: "NOERROR",
+	1: "FORMERR",
+	2: "SERVFAIL",
+	3: "NXDOMAIN",
+	4: "NOTIMP",
+	5: "REFUSED",
+}
+
+const (
+	DefaultDNSName = "."
+	DefaultDNSType = 2 // NS, which any resolver can answer for the root
+)
+
+type DNSAnswer struct {
+	rrtype uint16
+	value  string
+}
+
+// DNS probe. Sends a real query, over UDP or TCP, and checks the RCODE and optionally the answers.
+// afnet is dns, dns4, dns6, dns+tcp, dns+tcp4 or dns+tcp6
+func runDNSTest(afnet string, test *SubTest, p *ICMPPublisher) {
+	debug.Println("Doing DNS test")
+
+	tcp := strings.HasPrefix(afnet, "dns+tcp")
+	network := "udp" + strings.TrimPrefix(afnet, "dns")
+	if tcp {
+		network = "tcp" + strings.TrimPrefix(afnet, "dns+tcp")
+	}
+	test.raddr = withDefaultPort(test.raddr, "53")
+
+	test.run = true
+	conn, err := dialSubTest(network, test)
+	if err != nil {
+		test.state = connectErrorState(err)
+		test.refused = isConnRefused(err)
+		test.error = "DNS Connect error: " + err.Error()
+		return
+	}
+	defer conn.Close()
+	if !tcp {
+		enableRecvErr(conn.(*net.UDPConn))
+	}
+
+	qname, qtype := DefaultDNSName, uint16(DefaultDNSType)
+	if test.opts.dnsName != "" {
+		qname = test.opts.dnsName
+	}
+	if test.opts.dnsType != 0 {
+		qtype = test.opts.dnsType
+	}
+	id := uint16(rand.Intn(0x10000))
+	query, err := buildDNSQuery(id, qname, qtype)
+	if err != nil {
+		test.error = "DNS query error: " + err.Error()
+		return
+	}
+
+	start := time.Now()
+	reply, err := dnsExchange(conn, id, query, tcp, testTimeout(test.opts))
+	if err != nil {
+		if !tcp {
+			recordUDPError(test, conn.(*net.UDPConn), err, "DNS")
+			return
+		}
+		test.state = connectErrorState(err)
+		test.error = "DNS error: " + err.Error()
+		return
+	}
+	test.rtt = time.Since(start)
+	test.state = StateAnswered
+
+	rcode, truncated, answers, err := parseDNSResponse(reply)
+	if err != nil {
+		test.error = "DNS reply error: " + err.Error()
+		return
+	}
+	values := make([]string, len(answers))
+	for i, answer := range answers {
+		values[i] = answer.value
+	}
+	test.info = fmt.Sprintf("%s %s %s, %d answers", qname, dnsTypeName(qtype), dnsRcodeName(rcode), len(answers))
+	if len(values) > 0 {
+		test.info += ": " + strings.Join(values, " ")
+	}
+
+	if test.opts.dnsRcode >= 0 && rcode != test.opts.dnsRcode {
+		test.error = fmt.Sprintf("Got RCODE %s, expected %s", dnsRcodeName(rcode), dnsRcodeName(test.opts.dnsRcode))
+		return
+	}
+	for _, want := range test.opts.dnsAnswers {
+		found := false
+		for _, value := range values {
+			if dnsAnswerMatches(value, want) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			test.error = "Answer " + want + " missing from the reply"
+			if truncated {
+				test.error += " (reply was truncated, try dns+tcp)"
+			}
+			return
+		}
+	}
+	test.passed = true
+	debug.Println("*****Completed: ", fmtSubTest(*test))
+}
+
+// Names in the reply are fully qualified, so the trailing dot is optional in answer=
+func dnsAnswerMatches(value, want string) bool {
+	return strings.EqualFold(strings.TrimSuffix(value, "."), strings.TrimSuffix(want, "."))
+}
+
+// Send the query and wait for the reply with the same ID. TCP messages have a two byte length in front.
+func dnsExchange(conn net.Conn, id uint16, query []byte, tcp bool, dur time.Duration) ([]byte, error) {
+	conn.SetDeadline(time.Now().Add(dur))
+
+	var err error
+	if tcp {
+		query = append([]byte{byte(len(query) >> 8), byte(len(query))}, query...)
+	}
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	for {
+		var reply []byte
+		if tcp {
+			var length [2]byte
+			if _, err = io.ReadFull(conn, length[:]); err != nil {
+				return nil, err
+			}
+			reply = make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err = io.ReadFull(conn, reply); err != nil {
+				return nil, err
+			}
+		} else {
+			reply = make([]byte, 65535)
+			n, err := conn.Read(reply)
+			if err != nil {
+				return nil, err
+			}
+			reply = reply[:n]
+		}
+		if len(reply) >= 2 && binary.BigEndian.Uint16(reply) == id {
+			return reply, nil
+		}
+		debug.Println("Ignoring DNS reply with the wrong ID")
+	}
+}
+
+func buildDNSQuery(id uint16, qname string, qtype uint16) ([]byte, error) {
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:], id)
+	b[2] = 0x01 // RD, we want resolvers to resolve
+	binary.BigEndian.PutUint16(b[4:], 1)
+
+	name := strings.TrimSuffix(qname, ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid name %q", qname)
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	b = append(b, 0)
+	b = append(b, byte(qtype>>8), byte(qtype), 0, 1) // class IN
+	return b, nil
+}
+
+func parseDNSResponse(b []byte) (rcode int, truncated bool, answers []DNSAnswer, err error) {
+	if len(b) < 12 {
+		return 0, false, nil, errors.New("short reply")
+	}
+	if b[2]&0x80 == 0 {
+		return 0, false, nil, errors.New("not a reply")
+	}
+	truncated = b[2]&0x02 != 0
+	rcode = int(b[3] & 0x0f)
+	qdcount := int(binary.BigEndian.Uint16(b[4:]))
+	ancount := int(binary.BigEndian.Uint16(b[6:]))
+
+	offset := 12
+	for i := 0; i < qdcount; i++ {
+		if _, offset, err = readDNSName(b, offset); err != nil {
+			return
+		}
+		offset += 4
+	}
+	for i := 0; i < ancount; i++ {
+		if _, offset, err = readDNSName(b, offset); err != nil {
+			return
+		}
+		if len(b) < offset+10 {
+			err = errors.New("truncated answer")
+			return
+		}
+		rrtype := binary.BigEndian.Uint16(b[offset:])
+		rdlength := int(binary.BigEndian.Uint16(b[offset+8:]))
+		offset += 10
+		if len(b) < offset+rdlength {
+			err = errors.New("truncated answer")
+			return
+		}
+		answers = append(answers, DNSAnswer{rrtype, formatRData(b, offset, rrtype, b[offset:offset+rdlength])})
+		offset += rdlength
+	}
+	return
+}
+
+// Present the answer the way people write it in a zone file, more or less
+func formatRData(msg []byte, offset int, rrtype uint16, rdata []byte) string {
+	switch rrtype {
+	case 1, 28:
+		if len(rdata) == 4 || len(rdata) == 16 {
+			return net.IP(rdata).String()
+		}
+	case 2, 5, 12:
+		if name, _, err := readDNSName(msg, offset); err == nil {
+			return name
+		}
+	case 15:
+		if len(rdata) > 2 {
+			if name, _, err := readDNSName(msg, offset+2); err == nil {
+				return fmt.Sprintf("%d %s", binary.BigEndian.Uint16(rdata), name)
+			}
+		}
+	case 16:
+		var parts []string
+		for i := 0; i < len(rdata); {
+			l := int(rdata[i])
+			if i+1+l > len(rdata) {
+				break
+			}
+			parts = append(parts, string(rdata[i+1:i+1+l]))
+			i += 1 + l
+		}
+		return strings.Join(parts, "")
+	}
+	return fmt.Sprintf("%x", rdata)
+}
+
+// Read a possibly compressed name starting at offset, returning it and the offset just past it
+func readDNSName(b []byte, offset int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if offset >= len(b) {
+			return "", 0, errors.New("truncated name")
+		}
+		l := int(b[offset])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case l&0xc0 == 0xc0:
+			if offset+1 >= len(b) {
+				return "", 0, errors.New("truncated name")
+			}
+			if jumps++; jumps > 10 {
+				return "", 0, errors.New("name compression loop")
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			offset = (l&0x3f)<<8 | int(b[offset+1])
+		default:
+			if offset+1+l > len(b) {
+				return "", 0, errors.New("truncated name")
+			}
+			labels = append(labels, string(b[offset+1:offset+1+l]))
+			offset += 1 + l
+		}
+	}
+}
+
+func parseDNSType(s string) (uint16, error) {
+	if t, ok := DNSTypes[strings.ToUpper(s)]; ok {
+		return t, nil
+	}
+	t, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, errors.New("unknown query type")
+	}
+	return uint16(t), nil
+}
+
+func dnsTypeName(t uint16) string {
+	for name, value := range DNSTypes {
+		if value == t {
+			return name
+		}
+	}
+	return strconv.Itoa(int(t))
+}
+
+// Expected RCODE by name or number, or any
+func parseDNSRcode(s string) (int, error) {
+	if strings.EqualFold(s, "any") {
+		return -1, nil
+	}
+	for rcode, name := range DNSRcodes {
+		if strings.EqualFold(s, name) {
+			return rcode, nil
+		}
+	}
+	rcode, err := strconv.ParseUint(s, 10, 4)
+	if err != nil {
+		return 0, errors.New("unknown rcode")
+	}
+	return int(rcode), nil
+}
+
+func dnsRcodeName(rcode int) string {
+	if name, ok := DNSRcodes[rcode]; ok {
+		return name
+	}
+	return strconv.Itoa(rcode)
+}
@@ -0,0 +1,91 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestBuildDNSQuery(t *testing.T) {
+	query, err := buildDNSQuery(0xbeef, "fitzsimons.org.", 1)
+	if err != nil {
+		t.Fatal("Failed to build query:", err)
+	}
+	want := "\xbe\xef\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00\x0afitzsimons\x03org\x00\x00\x01\x00\x01"
+	if string(query) != want {
+		t.Fatalf("Query built incorrectly: %q", query)
+	}
+	if query, err = buildDNSQuery(1, ".", 2); err != nil || len(query) != 17 {
+		t.Fatalf("Root query built incorrectly: %q %v", query, err)
+	}
+	if _, err = buildDNSQuery(1, "bad..name", 1); err == nil {
+		t.Fatal("Empty label accepted")
+	}
+}
+
+func TestParseDNSResponse(t *testing.T) {
+	query, _ := buildDNSQuery(0xbeef, "fitzsimons.org", 15)
+	reply := append([]byte{}, query...)
+	reply[2], reply[3] = 0x81, 0x80 // QR RD RA, NOERROR
+	reply[7] = 2
+	// two answers, both using compression back to the question
+	reply = append(reply, 0xc0, 12, 0, 15, 0, 1, 0, 0, 0x0e, 0x10, 0, 9, 0, 10, 4, 'm', 'a', 'i', 'l', 0xc0, 12)
+	reply = append(reply, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0x0e, 0x10, 0, 4, 192, 0, 2, 1)
+
+	rcode, truncated, answers, err := parseDNSResponse(reply)
+	if err != nil {
+		t.Fatal("Failed to parse reply:", err)
+	}
+	if rcode != 0 || truncated || len(answers) != 2 {
+		t.Fatalf("Reply header parsed incorrectly: %d %v %+v", rcode, truncated, answers)
+	}
+	if answers[0].value != "10 mail.fitzsimons.org." || answers[1].value != "192.0.2.1" {
+		t.Fatalf("Answers parsed incorrectly: %+v", answers)
+	}
+
+	reply[3] = 0x83 // NXDOMAIN
+	if rcode, _, _, _ = parseDNSResponse(reply); rcode != 3 {
+		t.Fatal("RCODE parsed incorrectly:", rcode)
+	}
+	if _, _, _, err = parseDNSResponse(reply[:len(reply)-3]); err == nil {
+		t.Fatal("Truncated reply accepted")
+	}
+}
+
+func TestDNSAnswerMatches(t *testing.T) {
+	var tests = []struct {
+		Value   string
+		Want    string
+		Matches bool
+	}{
+		{"10 mail.fitzsimons.org.", "10 mail.fitzsimons.org.", true},
+		{"10 mail.fitzsimons.org.", "10 mail.fitzsimons.org", true},
+		{"mail.fitzsimons.org.", "MAIL.fitzsimons.org", true},
+		{"192.0.2.1", "192.0.2.1", true},
+		{"10 mail.fitzsimons.org.", "20 mail.fitzsimons.org", false},
+		{"mail.fitzsimons.org.", "mail.fitzsimons", false},
+	}
+	for count, test := range tests {
+		if dnsAnswerMatches(test.Value, test.Want) != test.Matches {
+			t.Fatalf("Line %d: %q against answer=%q should have matched=%v", count+1, test.Value, test.Want, test.Matches)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/droundy/goopt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With --listen conchk keeps running, and runs the tests every --interval. The results of the last run are served on
+// /metrics for Prometheus to scrape, so a broken flow can alert like anything else.
+type exporter struct {
+	mu          sync.Mutex
+	metrics     string      // for the last complete run, so a scrape never sees a run in progress
+	runs        int         // completed runs
+	lastSuccess []time.Time // when each of TestsInFile last passed
+}
+
+func runExporter(p *ICMPPublisher) {
+	interval, err := time.ParseDuration(*params.Interval)
+	if err != nil || interval <= 0 {
+		fatalf("Invalid --interval %q: it must be a duration like 30s or 5m", *params.Interval)
+	}
+
+	e := &exporter{lastSuccess: make([]time.Time, len(TestsInFile))}
+	e.update(TestsInFile, time.Time{}, time.Time{})
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", e)
+	go func() {
+		fatal("Cannot serve metrics on", *params.Listen, "due to error", http.ListenAndServe(*params.Listen, mux))
+	}()
+	log.Printf("Serving metrics on %s/metrics, running the tests every %s", *params.Listen, interval)
+
+	for {
+		start := time.Now()
+		runTests(p)
+		end := time.Now()
+		e.update(TestsInFile, start, end)
+
+		var numPassed uint
+		for _, test := range TestsInFile {
+			if !test.attempt {
+				continue
+			}
+			if test.passed {
+				numPassed++
+			} else {
+				log.Println(fmtTest(test))
+			}
+		}
+		log.Printf("== %d of %d tests passed ==", numPassed, ValidTests)
+
+		time.Sleep(time.Until(start.Add(interval)))
+		for idx := range TestsInFile {
+			TestsInFile[idx].reset()
+			if TestsInFile[idx].opts.resolveAll {
+				TestsInFile[idx].buildSubTests() // the names may point somewhere else by now
+			}
+		}
+	}
+}
+
+// Take in a run's results. The zero start time is for before the first run.
+func (e *exporter) update(tests []Test, start, end time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !start.IsZero() {
+		e.runs++
+		for idx, test := range tests {
+			if test.passed {
+				e.lastSuccess[idx] = end
+			}
+		}
+	}
+	e.metrics = prometheusMetrics(tests, e.lastSuccess, e.runs, start, end)
+}
+
+func (e *exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	metrics := e.metrics
+	e.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprint(w, metrics)
+}
+
+// The Prometheus text format for a run's results. Each test's metrics are labelled by its ref, protocol and
+// destination; tests that haven't run yet (or aren't for this host) have none.
+func prometheusMetrics(tests []Test, lastSuccess []time.Time, runs int, start, end time.Time) string {
+	var b strings.Builder
+	metric := func(name, help, kind string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	sample := func(name, labels string, value float64) {
+		fmt.Fprintf(&b, "%s%s %g\n", name, labels, value)
+	}
+
+	metric("conchk_info", "The version of conchk running.", "gauge")
+	sample("conchk_info", fmt.Sprintf("{version=%q}", goopt.Version), 1)
+	metric("conchk_runs_total", "Runs of the tests completed.", "counter")
+	sample("conchk_runs_total", "", float64(runs))
+	if !start.IsZero() {
+		metric("conchk_last_run_timestamp_seconds", "When the last run finished.", "gauge")
+		sample("conchk_last_run_timestamp_seconds", "", float64(end.UnixNano())/1e9)
+		metric("conchk_last_run_duration_seconds", "How long the last run took.", "gauge")
+		sample("conchk_last_run_duration_seconds", "", end.Sub(start).Seconds())
+	}
+
+	var run []int
+	for idx, test := range tests {
+		if test.attempt && test.run {
+			run = append(run, idx)
+		}
+	}
+	labels := promTestLabels
+
+	metric("conchk_test_up", "Whether the test passed on the last run.", "gauge")
+	for _, idx := range run {
+		sample("conchk_test_up", labels(tests[idx]), boolValue(tests[idx].passed))
+	}
+	metric("conchk_test_rtt_seconds", "Average round trip or connect time of the test's subtests that measure it.", "gauge")
+	for _, idx := range run {
+		if rtt := testRTT(tests[idx]); rtt > 0 {
+			sample("conchk_test_rtt_seconds", labels(tests[idx]), rtt.Seconds())
+		}
+	}
+	metric("conchk_test_duration_seconds", "How long the test took, including retries.", "gauge")
+	for _, idx := range run {
+		sample("conchk_test_duration_seconds", labels(tests[idx]), tests[idx].elapsed.Seconds())
+	}
+	metric("conchk_test_last_success_timestamp_seconds", "When the test last passed.", "gauge")
+	for _, idx := range run {
+		if !lastSuccess[idx].IsZero() {
+			sample("conchk_test_last_success_timestamp_seconds", labels(tests[idx]), float64(lastSuccess[idx].UnixNano())/1e9)
+		}
+	}
+	metric("conchk_test_subtests", "The test's subtests by result: passed, refused or failed for any other reason.", "gauge")
+	for _, idx := range run {
+		counts := map[string]int{}
+		for subTestV := tests[idx].subTests.Front(); subTestV != nil; subTestV = subTestV.Next() {
+			subTest := subTestV.Value.(*SubTest)
+			switch {
+			case subTest.passed:
+				counts["passed"]++
+			case subTest.refused:
+				counts["refused"]++
+			default:
+				counts["failed"]++
+			}
+		}
+		l := labels(tests[idx])
+		for _, result := range []string{"passed", "refused", "failed"} {
+			sample("conchk_test_subtests", l[:len(l)-1]+`,result="`+result+`"}`, float64(counts[result]))
+		}
+	}
+
+	subTestLabels := func(test Test, subTest *SubTest) string {
+		subref := subTest.subref
+		if subref == "" {
+			subref = test.ref
+		}
+		return fmt.Sprintf(`{ref="%s",subtest="%s",protocol="%s",destination="%s"}`, promEscape(test.ref), promEscape(subref), promEscape(subTest.net), promEscape(subTest.raddr))
+	}
+	subTestSamples := func(name string, value func(*SubTest) (float64, bool)) {
+		for _, idx := range run {
+			for subTestV := tests[idx].subTests.Front(); subTestV != nil; subTestV = subTestV.Next() {
+				subTest := subTestV.Value.(*SubTest)
+				if v, ok := value(subTest); ok {
+					sample(name, subTestLabels(tests[idx], subTest), v)
+				}
+			}
+		}
+	}
+	metric("conchk_subtest_up", "Whether the subtest passed on the last run.", "gauge")
+	subTestSamples("conchk_subtest_up", func(subTest *SubTest) (float64, bool) { return boolValue(subTest.passed), true })
+	metric("conchk_subtest_refused", "Whether the subtest was refused on the last run.", "gauge")
+	subTestSamples("conchk_subtest_refused", func(subTest *SubTest) (float64, bool) { return boolValue(subTest.refused), true })
+	metric("conchk_subtest_rtt_seconds", "Round trip or connect time of the subtest, if it measures it.", "gauge")
+	subTestSamples("conchk_subtest_rtt_seconds", func(subTest *SubTest) (float64, bool) { return subTest.rtt.Seconds(), subTest.rtt > 0 })
+	metric("conchk_subtest_attempts", "How many times the subtest's probe ran on the last run, including retries.", "gauge")
+	subTestSamples("conchk_subtest_attempts", func(subTest *SubTest) (float64, bool) { return float64(subTest.attempts), true })
+	return b.String()
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func promTestLabels(test Test) string {
+	return fmt.Sprintf(`{ref="%s",protocol="%s",destination="%s"}`, promEscape(test.ref), promEscape(test.net), promEscape(test.raddr))
+}
+
+// For --outputprom: the metrics for node_exporter's textfile collector. It's written to a temporary file that's then
+// renamed, so the collector never reads half of it. When a test didn't pass this time, its last success is carried
+// over from the file being replaced, since each run is usually a new process.
+func writeTextfile(name string, tests []Test, start, end time.Time) error {
+	previous := make(map[string]time.Time)
+	if old, err := os.ReadFile(name); err == nil {
+		const prefix = "conchk_test_last_success_timestamp_seconds"
+		for _, line := range strings.Split(string(old), "\n") {
+			if !strings.HasPrefix(line, prefix+"{") {
+				continue
+			}
+			i := strings.LastIndex(line, " ")
+			if secs, err := strconv.ParseFloat(line[i+1:], 64); err == nil {
+				previous[line[len(prefix):i]] = time.Unix(0, int64(secs*1e9))
+			}
+		}
+	}
+	lastSuccess := make([]time.Time, len(tests))
+	for idx, test := range tests {
+		if test.passed {
+			lastSuccess[idx] = end
+		} else if test.attempt {
+			lastSuccess[idx] = previous[promTestLabels(test)]
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once it's been renamed
+	if _, err = tmp.WriteString(prometheusMetrics(tests, lastSuccess, 1, start, end)); err == nil {
+		err = tmp.Chmod(0644) // CreateTemp's 0600 would keep node_exporter out
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// Label values escape backslashes, double quotes and newlines
+func promEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,122 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	tests := []Test{
+		{ref: "1", net: "tcp4", raddr: "10.0.0.1:80-82", attempt: true, run: true, passed: true, elapsed: 2 * time.Second},
+		{ref: "2", net: "udp4", raddr: `odd"name`, attempt: true, run: true},
+		{ref: "3", net: "tcp4", raddr: "10.0.0.3:22"},
+	}
+	tests[0].subTests.PushBack(&SubTest{subref: "1.1", net: "tcp4", raddr: "10.0.0.1:80", run: true, passed: true, rtt: 250 * time.Millisecond, attempts: 1})
+	tests[0].subTests.PushBack(&SubTest{subref: "1.2", net: "tcp4", raddr: "10.0.0.1:81", run: true, refused: true, attempts: 1})
+	tests[0].subTests.PushBack(&SubTest{subref: "1.3", net: "tcp4", raddr: "10.0.0.1:82", run: true, refused: true, attempts: 1})
+	tests[1].subTests.PushBack(&SubTest{net: "udp4", raddr: `odd"name`, run: true, state: StateSilent, attempts: 2})
+	lastSuccess := []time.Time{start.Add(time.Second), start.Add(-time.Hour), {}}
+
+	metrics := prometheusMetrics(tests, lastSuccess, 5, start, start.Add(3*time.Second))
+	for _, want := range []string{
+		"conchk_runs_total 5\n",
+		"conchk_last_run_timestamp_seconds 1.700000003e+09\n",
+		"conchk_last_run_duration_seconds 3\n",
+		`conchk_test_up{ref="1",protocol="tcp4",destination="10.0.0.1:80-82"} 1` + "\n",
+		`conchk_test_up{ref="2",protocol="udp4",destination="odd\"name"} 0` + "\n",
+		`conchk_test_rtt_seconds{ref="1",protocol="tcp4",destination="10.0.0.1:80-82"} 0.25` + "\n",
+		`conchk_test_duration_seconds{ref="1",protocol="tcp4",destination="10.0.0.1:80-82"} 2` + "\n",
+		`conchk_test_last_success_timestamp_seconds{ref="2",protocol="udp4",destination="odd\"name"} 1.6999964e+09` + "\n",
+		`conchk_test_subtests{ref="1",protocol="tcp4",destination="10.0.0.1:80-82",result="refused"} 2` + "\n",
+		`conchk_test_subtests{ref="2",protocol="udp4",destination="odd\"name",result="failed"} 1` + "\n",
+		`conchk_subtest_up{ref="1",subtest="1.1",protocol="tcp4",destination="10.0.0.1:80"} 1` + "\n",
+		`conchk_subtest_refused{ref="1",subtest="1.2",protocol="tcp4",destination="10.0.0.1:81"} 1` + "\n",
+		`conchk_subtest_rtt_seconds{ref="1",subtest="1.1",protocol="tcp4",destination="10.0.0.1:80"} 0.25` + "\n",
+		`conchk_subtest_attempts{ref="2",subtest="2",protocol="udp4",destination="odd\"name"} 2` + "\n",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Fatalf("Metrics are missing %q:\n%s", want, metrics)
+		}
+	}
+	if strings.Contains(metrics, `ref="3"`) || strings.Contains(metrics, `conchk_test_rtt_seconds{ref="2"`) || strings.Contains(metrics, `conchk_subtest_rtt_seconds{ref="1",subtest="1.2"`) {
+		t.Fatalf("Metrics have tests that weren't run, or RTTs that weren't measured:\n%s", metrics)
+	}
+
+	e := &exporter{lastSuccess: make([]time.Time, len(tests))}
+	e.update(tests, time.Time{}, time.Time{})
+	e.update(tests, start, start.Add(time.Second))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	if !strings.Contains(string(body), "conchk_runs_total 1\n") || !e.lastSuccess[0].Equal(start.Add(time.Second)) || !e.lastSuccess[1].IsZero() {
+		t.Fatalf("Exporter didn't take in the run: %+v\n%s", e.lastSuccess, body)
+	}
+
+	tests[0].reset()
+	if tests[0].run || tests[0].passed || tests[0].subTests.Front().Value.(*SubTest).rtt != 0 {
+		t.Fatalf("Test wasn't reset for the next run: %+v", tests[0])
+	}
+}
+
+func TestWriteTextfile(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	tests := []Test{
+		{ref: "1", net: "tcp4", raddr: "10.0.0.1:80", attempt: true, run: true, passed: true},
+		{ref: "2", net: "tcp4", raddr: "10.0.0.2:80", attempt: true, run: true},
+	}
+	tests[0].subTests.PushBack(&SubTest{run: true, passed: true})
+	tests[1].subTests.PushBack(&SubTest{run: true})
+
+	name := filepath.Join(t.TempDir(), "conchk.prom")
+	if err := os.WriteFile(name, []byte(`conchk_test_last_success_timestamp_seconds{ref="2",protocol="tcp4",destination="10.0.0.2:80"} 1.6999964e+09`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeTextfile(name, tests, start, start.Add(time.Second)); err != nil {
+		t.Fatal("Failed to write the textfile:", err)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal("Failed to read the textfile back:", err)
+	}
+	for _, want := range []string{
+		`conchk_test_last_success_timestamp_seconds{ref="1",protocol="tcp4",destination="10.0.0.1:80"} 1.700000001e+09` + "\n",
+		`conchk_test_last_success_timestamp_seconds{ref="2",protocol="tcp4",destination="10.0.0.2:80"} 1.6999964e+09` + "\n",
+		`conchk_test_up{ref="2",protocol="tcp4",destination="10.0.0.2:80"} 0` + "\n",
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Fatalf("Textfile is missing %q:\n%s", want, data)
+		}
+	}
+	if info, err := os.Stat(name); err != nil || info.Mode().Perm() != 0644 {
+		t.Fatalf("Textfile should be readable by node_exporter: %v %v", info.Mode(), err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(name)); len(entries) != 1 {
+		t.Fatalf("Temporary file left behind: %v", entries)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Named groups of hosts, for @name in the Hostname column. Members can be names, patterns or other @groups.
+var HostGroups = make(map[string][]string)
+
+// Read a groups file: one group per line, the group name then its members, comma separated. # starts a comment.
+func readHostGroups(r io.Reader) (map[string][]string, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	lines, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string][]string)
+	for _, line := range lines {
+		name := strings.TrimPrefix(strings.TrimSpace(line[0]), "@")
+		if name == "" {
+			continue
+		}
+		for _, member := range line[1:] {
+			if member = strings.TrimSpace(member); member != "" {
+				groups[name] = append(groups[name], member)
+			}
+		}
+	}
+	return groups, nil
+}
+
+func addHostGroups(groups map[string][]string) error {
+	for name, members := range groups {
+		name = strings.TrimPrefix(name, "@")
+		if _, ok := HostGroups[name]; ok {
+			return fmt.Errorf("host group %s is defined twice", name)
+		}
+		HostGroups[name] = members
+	}
+	return nil
+}
+
+// Does a Hostname column entry apply to this host? It can be
+//   - the host name, ignoring case
+//   - a glob, e.g. web-* or db[12].example.com
+//   - a regular expression between slashes, e.g. /^web-[0-9]+$/, which must match the whole name
+//   - @group, for any member of a group
+func hostMatches(pattern, host string) (bool, error) {
+	return hostMatchesGroup(pattern, host, nil)
+}
+
+func hostMatchesGroup(pattern, host string, seen []string) (bool, error) {
+	switch {
+	case strings.HasPrefix(pattern, "@"):
+		name := pattern[1:]
+		for _, s := range seen {
+			if s == name {
+				return false, fmt.Errorf("host group %s includes itself", name)
+			}
+		}
+		members, ok := HostGroups[name]
+		if !ok {
+			return false, fmt.Errorf("no host group %s", name)
+		}
+		for _, member := range members {
+			if match, err := hostMatchesGroup(member, host, append(seen, name)); match || err != nil {
+				return match, err
+			}
+		}
+		return false, nil
+	case len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"):
+		re, err := regexp.Compile("^(?:" + pattern[1:len(pattern)-1] + ")$")
+		if err != nil {
+			return false, err
+		}
+		return re.MatchString(host), nil
+	case strings.ContainsAny(pattern, "*?["):
+		return path.Match(strings.ToLower(pattern), strings.ToLower(host))
+	}
+	return strings.EqualFold(pattern, host), nil
+}
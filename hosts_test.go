@@ -0,0 +1,70 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHostMatches(t *testing.T) {
+	groups, err := readHostGroups(strings.NewReader("# name,members...\n@dmz-proxies, proxy1, proxy2.example.com\nweb,web-*,@dmz-proxies\nloop,@loop\n"))
+	if err != nil {
+		t.Fatal("Failed to read host groups:", err)
+	}
+	defer func(saved map[string][]string) { HostGroups = saved }(HostGroups)
+	HostGroups = make(map[string][]string)
+	if err = addHostGroups(groups); err != nil {
+		t.Fatal("Failed to add host groups:", err)
+	}
+	if err = addHostGroups(map[string][]string{"@web": nil}); err == nil {
+		t.Fatal("Host group defined twice")
+	}
+
+	var tests = []struct {
+		Pattern string
+		Host    string
+		Match   bool
+		Err     bool
+	}{
+		{"web01", "web01", true, false},
+		{"web01", "WEB01", true, false},
+		{"web01", "web011", false, false},
+		{"web-*", "web-17", true, false},
+		{"web-*", "db-1", false, false},
+		{"db[12].example.com", "db2.example.com", true, false},
+		{"/^web-[0-9]+$/", "web-17", true, false},
+		{"/web-[0-9]/", "web-17", false, false}, // the whole name has to match
+		{"/web-(/", "web-1", false, true},
+		{"@dmz-proxies", "proxy2.example.com", true, false},
+		{"@dmz-proxies", "proxy3", false, false},
+		{"@web", "proxy1", true, false},
+		{"@web", "web-1", true, false},
+		{"@nosuchgroup", "web-1", false, true},
+		{"@loop", "web-1", false, true},
+	}
+	for count, test := range tests {
+		match, err := hostMatches(test.Pattern, test.Host)
+		if match != test.Match || (err != nil) != test.Err {
+			t.Fatalf("Line %d %s for host %s should be %v, got %v %v", count+1, test.Pattern, test.Host, test.Match, match, err)
+		}
+	}
+}
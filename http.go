@@ -0,0 +1,198 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/droundy/goopt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const HTTPMaxBody = 1 << 20 // we only look at this much of the body for body=
+
+// HTTP(S) probe. Makes a real request and checks the status, headers and body, so a load balancer VIP with no
+// healthy backends doesn't pass just because it accepts connections. afnet is http, http4, http6, https, https4 or https6
+func runHTTPTest(afnet string, test *SubTest, p *ICMPPublisher) {
+	debug.Println("Doing HTTP test")
+
+	secure := strings.HasPrefix(afnet, "https")
+	scheme, port := "http", "80"
+	if secure {
+		scheme, port = "https", "443"
+	}
+	network := "tcp" + strings.TrimPrefix(afnet, scheme)
+	test.raddr = withDefaultPort(test.raddr, port)
+	test.run = true
+
+	dur := testTimeout(test.opts)
+	var err error
+
+	host := test.opts.httpHost
+	if host == "" {
+		// as a browser would have it, with the port unless it's the scheme's default
+		host = test.remoteName()
+		if _, rport, err := net.SplitHostPort(test.raddr); err == nil && rport != port {
+			host = net.JoinHostPort(host, rport)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+	}
+	serverName := test.opts.tlsServerName
+	verifyName := serverName
+	if serverName == "" {
+		verifyName, _, err = net.SplitHostPort(host)
+		if err != nil {
+			verifyName = strings.Trim(host, "[]")
+		}
+		serverName = verifyName
+		if net.ParseIP(serverName) != nil {
+			serverName = "" // SNI can't be an address, but the certificate still has to be for it
+		}
+	}
+
+	transport := &http.Transport{
+		Proxy:             nil, // we're testing the path to the server, not the proxy
+		DisableKeepAlives: true,
+		// whatever the URL says, connect to the address in the test, from the address in the test
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialSubTest(network, test)
+		},
+		TLSClientConfig: &tls.Config{
+			ServerName:         serverName,
+			MinVersion:         test.opts.tlsMinVersion,
+			InsecureSkipVerify: true, // checked with checkTLSState, as for tls tests
+		},
+		TLSHandshakeTimeout: dur,
+	}
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   dur,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse // a redirect is an answer in its own right
+		},
+	}
+
+	method, path := "GET", "/"
+	if test.opts.httpMethod != "" {
+		method = test.opts.httpMethod
+	}
+	if test.opts.httpPath != "" {
+		path = test.opts.httpPath
+	}
+	req, err := http.NewRequest(method, scheme+"://"+host+path, nil)
+	if err != nil {
+		test.error = "HTTP Request error: " + err.Error()
+		return
+	}
+	req.Header.Set("User-Agent", "conchk/"+goopt.Version)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		test.state = connectErrorState(err)
+		test.refused = isConnRefused(err)
+		test.error = "HTTP error: " + err.Error()
+		return
+	}
+	defer resp.Body.Close()
+	test.rtt = time.Since(start)
+	test.state = StateAnswered
+	test.info = resp.Proto + " " + resp.Status
+
+	if resp.TLS != nil {
+		info, err := checkTLSState(*resp.TLS, verifyName, test.opts, time.Now())
+		test.info += "; " + info
+		if err != nil {
+			test.error = err.Error()
+			return
+		}
+	}
+
+	if !statusOK(resp.StatusCode, test.opts.httpStatus) {
+		want := "below 400"
+		if len(test.opts.httpStatus) > 0 {
+			want = strings.Join(test.opts.httpStatus, ",")
+		}
+		test.error = fmt.Sprintf("Status %d, expected %s", resp.StatusCode, want)
+		return
+	}
+	for _, header := range test.opts.httpHeaders {
+		if err = checkHeader(resp.Header, header); err != nil {
+			test.error = err.Error()
+			return
+		}
+	}
+	if test.opts.httpBody != "" {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, HTTPMaxBody))
+		if err != nil {
+			test.error = "HTTP body error: " + err.Error()
+			return
+		}
+		if !strings.Contains(string(body), test.opts.httpBody) {
+			test.error = fmt.Sprintf("Body does not contain %q", test.opts.httpBody)
+			return
+		}
+	}
+	test.passed = true
+	debug.Println("*****Completed: ", fmtSubTest(*test))
+}
+
+// Status codes can be given exactly (200) or by class (2xx). With none given anything below 400 will do.
+func statusOK(code int, allowed []string) bool {
+	if len(allowed) == 0 {
+		return code < 400
+	}
+	s := strconv.Itoa(code)
+	for _, want := range allowed {
+		if len(want) == 3 && strings.HasSuffix(strings.ToLower(want), "xx") && want[0] == s[0] {
+			return true
+		}
+		if want == s {
+			return true
+		}
+	}
+	return false
+}
+
+// header=Name requires the header be present, header=Name: value that its value contains value
+func checkHeader(headers http.Header, spec string) error {
+	name, want := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name, want = strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+	}
+	values, ok := headers[http.CanonicalHeaderKey(name)]
+	if !ok {
+		return fmt.Errorf("Header %s missing", name)
+	}
+	for _, value := range values {
+		if strings.Contains(value, want) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Header %s is %q, expected it to contain %q", name, strings.Join(values, ", "), want)
+}
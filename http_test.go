@@ -0,0 +1,124 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStatusOK(t *testing.T) {
+	var tests = []struct {
+		Code    int
+		Allowed []string
+		OK      bool
+	}{
+		{200, nil, true},
+		{302, nil, true},
+		{503, nil, false},
+		{204, []string{"2xx"}, true},
+		{301, []string{"200", "301"}, true},
+		{302, []string{"200", "301"}, false},
+		{404, []string{"2XX", "404"}, true},
+	}
+	for count, test := range tests {
+		if statusOK(test.Code, test.Allowed) != test.OK {
+			t.Fatalf("Line %d status %d with %v should be %v", count+1, test.Code, test.Allowed, test.OK)
+		}
+	}
+}
+
+func TestHTTPProbe(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			http.Error(w, "no healthy backends", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("X-Backend", "web-3")
+		fmt.Fprintf(w, "hello %s", r.Host)
+	}))
+	defer srv.Close()
+	raddr := strings.TrimPrefix(srv.URL, "http://")
+
+	var tests = []struct {
+		Options []string
+		Passed  bool
+	}{
+		{nil, true},
+		{[]string{"body=hello " + raddr}, true}, // the Host header keeps the port
+		{[]string{"path=/down"}, false},
+		{[]string{"path=/down", "status=503"}, true},
+		{[]string{"header=X-Backend: web-", "body=hello www.example.com", "host=www.example.com"}, true},
+		{[]string{"header=X-Missing"}, false},
+		{[]string{"body=goodbye"}, false},
+	}
+	for count, test := range tests {
+		opts, err := parseTestOptions(test.Options)
+		if err != nil {
+			t.Fatalf("Line %d options rejected: %v", count+1, err)
+		}
+		subTest := SubTest{net: "http", raddr: raddr, opts: opts}
+		runHTTPTest("http", &subTest, nil)
+		if subTest.passed != test.Passed {
+			t.Fatalf("Line %d should have passed=%v: %s", count+1, test.Passed, fmtSubTest(subTest))
+		}
+	}
+}
+
+func TestHTTPSProbeAddress(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	raddr := strings.TrimPrefix(srv.URL, "https://")
+
+	cafile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(cafile, ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		Options []string
+		Passed  bool
+	}{
+		{[]string{"cafile=" + cafile, "status=404"}, true},                   // the certificate is for 127.0.0.1
+		{[]string{"cafile=" + cafile, "status=404", "host=10.0.0.1"}, false}, // but not for 10.0.0.1
+	}
+	for count, test := range tests {
+		opts, err := parseTestOptions(test.Options)
+		if err == nil {
+			err = opts.loadFiles()
+		}
+		if err != nil {
+			t.Fatalf("Line %d options rejected: %v", count+1, err)
+		}
+		subTest := SubTest{net: "https", raddr: raddr, opts: opts}
+		runHTTPTest("https", &subTest, nil)
+		if subTest.passed != test.Passed {
+			t.Fatalf("Line %d should have passed=%v: %s", count+1, test.Passed, fmtSubTest(subTest))
+		}
+	}
+}
@@ -24,17 +24,25 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"os"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 type ICMPMessage struct {
-	msgtype       int8
+	msgtype       uint8
 	code          int8
 	desc          string
 	originalRAddr string
 	originalLAddr string
 	originalProto string
+	from          string // the address the ICMP message came from
+	id            int    // echo identifier, from an echo reply or the echo request embedded in an error
+	seq           int    // echo sequence number, as for id
+	mtu           int    // next hop MTU from a v4 fragmentation needed or v6 packet too big message
+	v6            bool   // ICMPv6 and ICMPv4 reuse type numbers, so we need to know which this is
 }
 
 type ICMPPublisher struct {
@@ -45,6 +53,14 @@ type ICMPPublisher struct {
 
 const ChanDepth = 10
 
+// Number of echo requests sent by a ping test. They are spread over the timeout, and the first reply wins.
+const PingCount = 3
+
+// Shortest gap between those echo requests, however short the timeout
+const MinPingInterval = time.Millisecond
+
+var pingIDs uint32 // gives every ping subtest its own ICMP identifier
+
 const (
 	ICMP4_ECHO_REQUEST      = 8
 	ICMP4_ECHO_REPLY        = 0
@@ -93,6 +109,32 @@ var ICMP4UnreachableCodes map[int8]string = map[int8]string{
 	15: "Precedence cutoff in effect (precedence of datagram is below the level set by the network administrators)",
 }
 
+// ICMP6_DEST_UNREACHABLE codes
+var ICMP6UnreachableCodes map[int8]string = map[int8]string{
+	0: "No route to destination",
+	1: "Communication with destination administratively prohibited",
+	2: "Beyond scope of source address",
+	3: "Address unreachable",
+	4: "Port unreachable",
+	5: "Source address failed ingress/egress policy",
+	6: "Reject route to destination",
+	7: "Error in source routing header",
+}
+
+// ICMP6_TIME_EXCEEDED codes
+var ICMP6TimeExceededCodes map[int8]string = map[int8]string{
+	0: "Hop limit exceeded in transit",
+	1: "Fragment reassembly time exceeded",
+}
+
+// ICMP6_PARAMETER_PROBLEM codes
+var ICMP6ParameterProblemCodes map[int8]string = map[int8]string{
+	0: "Erroneous header field encountered",
+	1: "Unrecognized Next Header type encountered",
+	2: "Unrecognized IPv6 option encountered",
+	3: "IPv6 first fragment has incomplete IPv6 header chain",
+}
+
 var IPProtocol map[uint8]string = map[uint8]string{
 	1:   "ICMP",
 	2:   "IGMP",
@@ -100,6 +142,7 @@ var IPProtocol map[uint8]string = map[uint8]string{
 	17:  "UDP",
 	41:  "ENCAP",
 	89:  "OSPF",
+	58:  "IPV6-ICMP",
 	132: "SCTP",
 }
 
@@ -139,45 +182,157 @@ func (p *ICMPPublisher) Unsubscribe(ch chan ICMPMessage) {
 	p.unsub <- ch
 }
 
-func waitForPossibleICMP(test *SubTest, icmpCh chan ICMPMessage) bool {
-	timeout := make(chan bool, 1)
+// Wait for the far end to answer our datagram, or for an ICMP error about it, until the timeout.
+// As root we see the raw ICMP via icmpCh. Without root we can't, but a connected UDP socket is told about ICMP errors
+// for it by the kernel. A port unreachable shows up as ECONNREFUSED on a read on most platforms; on Linux IP_RECVERR
+// gets us every ICMP error, and the details of it, via the socket error queue.
+func waitForUDPReply(test *SubTest, conn *net.UDPConn, icmpCh chan ICMPMessage) {
+	conn.SetReadDeadline(time.Now().Add(testTimeout(test.opts)))
+
+	type reply struct {
+		data []byte
+		err  error
+	}
+	replies := make(chan reply)
+	done := make(chan empty)
+	defer close(done)
 	go func() {
-		dur, err := time.ParseDuration(*params.Timeout)
-		if err == nil {
-			time.Sleep(dur)
+		for {
+			buf := make([]byte, 1500)
+			n, err := conn.Read(buf)
+			select {
+			case replies <- reply{buf[:n], err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
 		}
-		timeout <- true
 	}()
 
+	test.run = true
+	mismatched := 0
 	for {
 		select {
-		case msg := <-icmpCh:
-			match, err := matchICMP(test, msg)
-			if match {
-				test.run = true
+		case msg := <-icmpCh: // never fires without root
+			if match, err := matchICMP(test, msg); match {
 				// any matching ICMP message is bad and invalidates the test, unless it's unreachable
-				test.passed = false
-				test.refused = false
-				if msg.msgtype == ICMP4_DEST_UNREACHABLE || msg.msgtype == ICMP6_DEST_UNREACHABLE {
-					test.refused = true
-				}
+				test.state = StateRejected
+				test.refused = msg.unreachable()
 				test.error = err.Error()
 				debug.Println(fmtSubTest(*test), "ICMP", err)
-				return true
+				return
+			}
+		case r := <-replies:
+			if r.err == nil {
+				test.state = StateAnswered
+				if test.opts.response == nil || test.opts.response.match(r.data) {
+					debug.Printf("Got an acceptable reply: %q", r.data)
+					test.passed = true
+					return
+				}
+				debug.Printf("Reply did not match: %q", r.data)
+				mismatched++
+				continue
+			}
+			if nerr, ok := r.err.(net.Error); ok && nerr.Timeout() { // this is the normal case
+				debug.Println("Timeout - exiting loop")
+				switch {
+				case test.state == StateAnswered:
+					test.error = fmt.Sprintf("%d replies, none matched response=%s", mismatched, test.opts.response)
+				case test.opts.response != nil:
+					test.state = StateSilent
+					test.error = "No reply"
+				default:
+					test.state = StateSilent
+					test.passed = true // no news is good news
+				}
+				return
 			}
-		case <-timeout: // this is the normal case
-			debug.Println("Timeout - exiting loop")
-			return false
+
+			test.state = StateRejected
+			msg, qerr := readErrQueue(conn)
+			if qerr != nil {
+				debug.Println("No error queue entry:", qerr)
+				test.refused = isConnRefused(r.err)
+				test.error = r.err.Error()
+				return
+			}
+			test.refused = msg.unreachable()
+			test.error = msg.desc
+			if msg.from != "" {
+				test.error += " (from " + msg.from + ")"
+			}
+			debug.Println(fmtSubTest(*test), "ICMP", msg.desc)
+			return
+		}
+	}
+}
+
+func isConnRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// Classify a failed connect: a RST or an ICMP error is a rejection, a timeout is silence (most likely a drop)
+func connectErrorState(err error) string {
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return StateSilent
+	}
+	for _, errno := range []syscall.Errno{syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.EHOSTUNREACH, syscall.ENETUNREACH} {
+		if errors.Is(err, errno) {
+			return StateRejected
+		}
+	}
+	return ""
+}
+
+// Description of an ICMP error, for when we don't have the whole message to hand to parseICMP
+func icmpErrorDesc(v6 bool, msgtype uint8, code int8) string {
+	var desc string
+	if v6 {
+		switch msgtype {
+		case ICMP6_DEST_UNREACHABLE:
+			desc = ICMP6UnreachableCodes[code]
+		case ICMP6_PACKET_TOO_BIG:
+			desc = "Packet too big."
+		case ICMP6_TIME_EXCEEDED:
+			desc = ICMP6TimeExceededCodes[code]
+		case ICMP6_PARAMETER_PROBLEM:
+			desc = ICMP6ParameterProblemCodes[code]
 		}
+	} else {
+		switch msgtype {
+		case ICMP4_DEST_UNREACHABLE:
+			desc = ICMP4UnreachableCodes[code]
+		case ICMP4_TIME_EXCEEDED:
+			desc = ICMP4TimeExceededCodes[code]
+		case ICMP4_PARAMETER_PROBLEM:
+			desc = ICMP4ParameterProblemCodes[code]
+		}
+	}
+	if desc == "" {
+		desc = fmt.Sprintf("ICMP type %d code %d", msgtype, code)
 	}
+	return desc
+}
+
+// Is this a destination unreachable, for either address family
+func (msg ICMPMessage) unreachable() bool {
+	if msg.v6 {
+		return msg.msgtype == ICMP6_DEST_UNREACHABLE
+	}
+	return msg.msgtype == ICMP4_DEST_UNREACHABLE
 }
 
-// TODO(bf) IPv6. Enough said.
 func matchICMP(test *SubTest, msg ICMPMessage) (bool, error) {
 	debug.Printf("Matching message %v to a test", msg)
+	if msg.originalProto == "" {
+		return false, nil
+	}
 	if test.laddr_used == msg.originalLAddr && test.raddr_used == msg.originalRAddr {
-		debug.Printf("Proto %s vs %s", strings.ToLower(msg.originalProto), test.net[:len(msg.originalProto)])
-		if strings.ToLower(msg.originalProto) == test.net[:len(msg.originalProto)] {
+		debug.Printf("Proto %s vs %s", strings.ToLower(msg.originalProto), test.net)
+		if strings.HasPrefix(test.net, strings.ToLower(msg.originalProto)) {
 			debug.Println("#################MATCH#############")
 			return true, errors.New(msg.desc)
 		}
@@ -206,12 +361,12 @@ func icmpListen(v6 bool, ch chan ICMPMessage) {
 
 	rawICMP := make([]byte, 256)
 	for {
-		_, fromAddr, err := c.ReadFrom(rawICMP)
+		n, fromAddr, err := c.ReadFrom(rawICMP)
 		if err != nil {
 			debug.Printf("ReadFrom failed: %v", err)
 			return
 		}
-		msg, err := parseICMP(v6, fromAddr, rawICMP)
+		msg, err := parseICMP(v6, fromAddr, rawICMP[:n])
 		if err != nil {
 			debug.Printf("parseICMP failed: %v", err)
 			continue
@@ -222,34 +377,86 @@ func icmpListen(v6 bool, ch chan ICMPMessage) {
 
 func parseICMP(v6 bool, fromAddr net.Addr, rawICMP []byte) (ICMPMessage, error) {
 	//debug.Printf("Got message from %v : %v", fromAddr, rawICMP)
+	if len(rawICMP) < 8 {
+		return ICMPMessage{}, errors.New("Short ICMP message")
+	}
+	msg := ICMPMessage{msgtype: rawICMP[0], code: int8(rawICMP[1]), from: ipOnly(fromAddr.String()), id: -1, seq: -1, v6: v6,
+		originalRAddr: "odest", originalLAddr: "osrc", originalProto: "oproto"}
 	if !v6 {
 		switch rawICMP[0] {
 		case ICMP4_ECHO_REQUEST:
 			debug.Printf("V4Echo Request from %v", fromAddr)
 		case ICMP4_ECHO_REPLY:
 			debug.Printf("V4Echo Reply from %v", fromAddr)
-			id, seq := parseICMPEchoReply(rawICMP)
-			return ICMPMessage{int8(rawICMP[0]), int8(rawICMP[1]), fmt.Sprintf("ID %d Sequence %d", id, seq), "odest", "osrc", "oproto"}, nil
+			msg.id, msg.seq = parseICMPEchoReply(rawICMP)
+			msg.desc = fmt.Sprintf("ID %d Sequence %d", msg.id, msg.seq)
+			return msg, nil
 		case ICMP4_DEST_UNREACHABLE:
 			debug.Printf("V4Dest Unreachable from %v", fromAddr)
-			s, d, p := parsev4(rawICMP[8:])
-			return ICMPMessage{int8(rawICMP[0]), int8(rawICMP[1]), ICMP4UnreachableCodes[int8(rawICMP[1])], d, s, p}, nil
+			msg.desc = ICMP4UnreachableCodes[msg.code]
+			if msg.code == 4 {
+				msg.mtu = int(rawICMP[6])<<8 | int(rawICMP[7])
+				msg.desc += fmt.Sprintf(" Next hop MTU %d.", msg.mtu)
+			}
+			msg.originalLAddr, msg.originalRAddr, msg.originalProto = parsev4(rawICMP[8:])
+			msg.id, msg.seq = parsev4Echo(rawICMP[8:])
+			return msg, nil
 		case ICMP4_TIME_EXCEEDED:
 			debug.Printf("V4Time Exceeded from %v", fromAddr)
-			s, d, p := parsev4(rawICMP[8:])
-			return ICMPMessage{int8(rawICMP[0]), int8(rawICMP[1]), ICMP4TimeExceededCodes[int8(rawICMP[1])], d, s, p}, nil
+			msg.desc = ICMP4TimeExceededCodes[msg.code]
+			msg.originalLAddr, msg.originalRAddr, msg.originalProto = parsev4(rawICMP[8:])
+			msg.id, msg.seq = parsev4Echo(rawICMP[8:])
+			return msg, nil
 		case ICMP4_PARAMETER_PROBLEM:
 			debug.Printf("V4Parameter Problem from %v", fromAddr)
-			return ICMPMessage{int8(rawICMP[0]), int8(rawICMP[1]), ICMP4ParameterProblemCodes[int8(rawICMP[1])], "odest", "osrc", "oproto"}, nil
+			msg.desc = ICMP4ParameterProblemCodes[msg.code]
+			return msg, nil
 		default:
 			return ICMPMessage{}, errors.New("Not a useful ICMPv4 message")
 		}
+	} else {
+		switch rawICMP[0] {
+		case ICMP6_ECHO_REQUEST:
+			debug.Printf("V6Echo Request from %v", fromAddr)
+		case ICMP6_ECHO_REPLY:
+			debug.Printf("V6Echo Reply from %v", fromAddr)
+			msg.id, msg.seq = parseICMPEchoReply(rawICMP)
+			msg.desc = fmt.Sprintf("ID %d Sequence %d", msg.id, msg.seq)
+			return msg, nil
+		case ICMP6_DEST_UNREACHABLE:
+			debug.Printf("V6Dest Unreachable from %v", fromAddr)
+			msg.desc = ICMP6UnreachableCodes[msg.code]
+		case ICMP6_PACKET_TOO_BIG:
+			debug.Printf("V6Packet Too Big from %v", fromAddr)
+			msg.mtu = int(rawICMP[4])<<24 | int(rawICMP[5])<<16 | int(rawICMP[6])<<8 | int(rawICMP[7])
+			msg.desc = fmt.Sprintf("Packet too big. Next hop MTU %d.", msg.mtu)
+		case ICMP6_TIME_EXCEEDED:
+			debug.Printf("V6Time Exceeded from %v", fromAddr)
+			msg.desc = ICMP6TimeExceededCodes[msg.code]
+		case ICMP6_PARAMETER_PROBLEM:
+			debug.Printf("V6Parameter Problem from %v", fromAddr)
+			pointer := int(rawICMP[4])<<24 | int(rawICMP[5])<<16 | int(rawICMP[6])<<8 | int(rawICMP[7])
+			msg.desc = fmt.Sprintf("%s at offset %d", ICMP6ParameterProblemCodes[msg.code], pointer)
+		default:
+			return ICMPMessage{}, errors.New("Not a useful ICMPv6 message")
+		}
+		if rawICMP[0] < ICMP6_ECHO_REQUEST { // all the errors carry as much of the original packet as fits
+			msg.originalLAddr, msg.originalRAddr, msg.originalProto = parsev6(rawICMP[8:])
+			msg.id, msg.seq = parsev6Echo(rawICMP[8:])
+			return msg, nil
+		}
 	}
 	return ICMPMessage{}, errors.New("Unparsable ICMP message")
 }
 
 func parsev4(b []byte) (originalLAddr, originalRAddr, originalProto string) {
+	if len(b) < 20 {
+		return
+	}
 	hdrlen := (int(b[0]) & 0x0f) << 2
+	if len(b) < hdrlen+4 {
+		return
+	}
 	originalProto = IPProtocol[uint8(b[9])]
 	originalLIP := net.IPv4(b[12], b[13], b[14], b[15]).String()
 	originalRIP := net.IPv4(b[16], b[17], b[18], b[19]).String()
@@ -259,3 +466,225 @@ func parsev4(b []byte) (originalLAddr, originalRAddr, originalProto string) {
 	originalRAddr = net.JoinHostPort(originalRIP, originalRPort)
 	return
 }
+
+// If the datagram embedded in an ICMPv4 error was one of our echo requests, return its identifier and sequence number.
+// Anything else returns -1,-1 so it can never match a ping test
+func parsev4Echo(b []byte) (id, seq int) {
+	if len(b) < 20 {
+		return -1, -1
+	}
+	hdrlen := (int(b[0]) & 0x0f) << 2
+	if b[9] != 1 || len(b) < hdrlen+8 || b[hdrlen] != ICMP4_ECHO_REQUEST {
+		return -1, -1
+	}
+	return parseICMPEchoReply(b[hdrlen:])
+}
+
+// Find the upper layer protocol and its offset in an IPv6 packet, skipping the extension headers we may see.
+// Returns an offset of -1 if the packet is truncated before we get there.
+func v6UpperLayer(b []byte) (proto uint8, offset int) {
+	if len(b) < 40 {
+		return 0, -1
+	}
+	proto, offset = b[6], 40
+	for {
+		switch proto {
+		case 0, 43, 60: // hop-by-hop, routing, destination options
+			if len(b) < offset+2 {
+				return proto, -1
+			}
+			proto, offset = b[offset], offset+(int(b[offset+1])+1)*8
+		case 44: // fragment
+			if len(b) < offset+8 {
+				return proto, -1
+			}
+			proto, offset = b[offset], offset+8
+		default:
+			return
+		}
+	}
+}
+
+// Same as parsev4, for the IPv6 packet embedded in an ICMPv6 error
+func parsev6(b []byte) (originalLAddr, originalRAddr, originalProto string) {
+	proto, offset := v6UpperLayer(b)
+	if offset < 0 || len(b) < offset+4 {
+		return
+	}
+	originalProto = IPProtocol[proto]
+	originalLIP := net.IP(b[8:24]).String()
+	originalRIP := net.IP(b[24:40]).String()
+	originalLPort := fmt.Sprintf("%d", int(b[offset])<<8|int(b[offset+1]))   // true for TCP/UDP/SCTP
+	originalRPort := fmt.Sprintf("%d", int(b[offset+2])<<8|int(b[offset+3])) // true for TCP/UDP/SCTP
+	originalLAddr = net.JoinHostPort(originalLIP, originalLPort)
+	originalRAddr = net.JoinHostPort(originalRIP, originalRPort)
+	return
+}
+
+// Same as parsev4Echo, for the IPv6 packet embedded in an ICMPv6 error
+func parsev6Echo(b []byte) (id, seq int) {
+	proto, offset := v6UpperLayer(b)
+	if proto != 58 || offset < 0 || len(b) < offset+8 || b[offset] != ICMP6_ECHO_REQUEST {
+		return -1, -1
+	}
+	return parseICMPEchoReply(b[offset:])
+}
+
+// Build an ICMP echo request (or reply), checksum included. The kernel recalculates the checksum for ICMPv6 anyway.
+func makeICMPEcho(msgtype, id, seq int, data []byte) []byte {
+	b := make([]byte, 8+len(data))
+	b[0] = byte(msgtype)
+	b[4], b[5] = byte(id>>8), byte(id)
+	b[6], b[7] = byte(seq>>8), byte(seq)
+	copy(b[8:], data)
+	cs := icmpChecksum(b)
+	b[2], b[3] = byte(cs>>8), byte(cs)
+	return b
+}
+
+// Standard internet checksum (RFC 1071)
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// Strip any port and zone from an address so ICMP source addresses can be compared with the ones we dialled
+func ipOnly(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if i := strings.LastIndex(addr, "%"); i >= 0 {
+		addr = addr[:i]
+	}
+	return addr
+}
+
+// A fresh ICMP echo identifier, so replies to concurrent tests (or other conchks) can be told apart
+func nextPingID() int {
+	return int((uint32(os.Getpid()) + atomic.AddUint32(&pingIDs, 1)) & 0xffff)
+}
+
+// The gap between echo requests, so that all PingCount of them go out within the timeout
+func pingInterval(timeout time.Duration) time.Duration {
+	if interval := timeout / PingCount; interval > MinPingInterval {
+		return interval
+	}
+	return MinPingInterval
+}
+
+// Ping test. Requests go out on a private raw socket bound to the test's local address, and the replies are
+// picked up from the ICMPPublisher and matched on the source, identifier and sequence number.
+func runICMPTest(afnet string, test *SubTest, p *ICMPPublisher) {
+	debug.Println("Doing ICMP echo test")
+
+	// "ip" will work for either family, so go by the address
+	v6 := afnet == "ip6" || (afnet == "ip" && isV6(test.raddr))
+	dialNet, echoRequest, echoReply := "ip4:icmp", ICMP4_ECHO_REQUEST, ICMP4_ECHO_REPLY
+	if v6 {
+		dialNet, echoRequest, echoReply = "ip6:ipv6-icmp", ICMP6_ECHO_REQUEST, ICMP6_ECHO_REPLY
+	}
+
+	if !gotRoot {
+		test.run = true
+		test.error = "ICMP tests require root access"
+		return
+	}
+
+	icmpCh := p.Subscribe()
+	defer p.Unsubscribe(icmpCh)
+
+	var d net.Dialer
+	var err error
+
+	if len(test.laddr) > 0 {
+		lhost, _, err := net.SplitHostPort(test.laddr)
+		if err != nil {
+			lhost = test.laddr
+		}
+		d.LocalAddr, err = net.ResolveIPAddr(dialNet[:3], strings.Trim(lhost, "[]"))
+		if err != nil {
+			test.run = true
+			test.error = "ICMP Resolve error: " + err.Error()
+			return
+		}
+	}
+
+	timeout := testTimeout(test.opts)
+	d.Timeout = timeout
+	conn, err := d.Dial(dialNet, strings.Trim(test.raddr, "[]"))
+	if err != nil {
+		test.run = true
+		test.error = "ICMP Dial error: " + err.Error()
+		return
+	}
+	defer conn.Close()
+	test.laddr_used = conn.LocalAddr().String()
+	test.raddr_used = conn.RemoteAddr().String()
+
+	id := nextPingID()
+	sent := make(map[int]time.Time)
+	send := func(seq int) error {
+		sent[seq] = time.Now()
+		_, err := conn.Write(makeICMPEcho(echoRequest, id, seq, []byte("conchk test packet")))
+		return err
+	}
+
+	if err = send(1); err != nil {
+		test.run = true
+		test.error = "ICMP Write error: " + err.Error()
+		return
+	}
+	ticker := time.NewTicker(pingInterval(timeout))
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+
+	for {
+		select {
+		case <-ticker.C:
+			if len(sent) < PingCount {
+				if err = send(len(sent) + 1); err != nil {
+					debug.Println("ICMP Write error:", err)
+				}
+			}
+		case msg := <-icmpCh:
+			if msg.v6 != v6 || msg.id != id {
+				continue
+			}
+			if _, ok := sent[msg.seq]; !ok {
+				continue
+			}
+			if int(msg.msgtype) == echoReply {
+				if msg.from != ipOnly(test.raddr_used) {
+					continue
+				}
+				test.rtt = time.Since(sent[msg.seq])
+				test.run = true
+				test.state = StateAnswered
+				test.passed = true
+				debug.Println("*****Completed: ", fmtSubTest(*test))
+				return
+			}
+			// only errors carry an embedded echo request, so this is the end of the road for this test
+			test.run = true
+			test.state = StateRejected
+			test.refused = msg.unreachable()
+			test.error = fmt.Sprintf("%s (from %s)", msg.desc, msg.from)
+			debug.Println(fmtSubTest(*test), "ICMP", msg.desc)
+			return
+		case <-deadline:
+			test.run = true
+			test.state = StateSilent
+			test.error = fmt.Sprintf("No ICMP echo reply to %d requests", len(sent))
+			return
+		}
+	}
+}
@@ -0,0 +1,134 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// from linux/errqueue.h
+const (
+	SO_EE_ORIGIN_ICMP  = 2
+	SO_EE_ORIGIN_ICMP6 = 3
+	sizeofExtendedErr  = 16
+)
+
+func isV6Conn(conn *net.UDPConn) bool {
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	return ok && addr.IP.To4() == nil
+}
+
+// Ask the kernel to queue all ICMP errors for this socket, not just the ones it considers fatal
+func enableRecvErr(conn *net.UDPConn) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	level, opt := syscall.IPPROTO_IP, syscall.IP_RECVERR
+	if isV6Conn(conn) {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_RECVERR
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), level, opt, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// Pull the oldest ICMP error off the socket error queue. There is no embedded datagram to look at, but then we know
+// it was ours.
+func readErrQueue(conn *net.UDPConn) (ICMPMessage, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return ICMPMessage{}, err
+	}
+	buf := make([]byte, 1500)
+	oob := make([]byte, 512)
+	var oobn int
+	var rerr error
+	err = rc.Control(func(fd uintptr) {
+		_, oobn, _, _, rerr = syscall.Recvmsg(int(fd), buf, oob, syscall.MSG_ERRQUEUE)
+	})
+	if err != nil {
+		return ICMPMessage{}, err
+	}
+	if rerr != nil {
+		return ICMPMessage{}, rerr
+	}
+
+	msg, err := parseErrQueue(oob[:oobn])
+	if err != nil {
+		return ICMPMessage{}, err
+	}
+	msg.originalLAddr = conn.LocalAddr().String()
+	msg.originalRAddr = conn.RemoteAddr().String()
+	msg.originalProto = "UDP"
+	return msg, nil
+}
+
+// Find the extended error in the control messages that came with an error queue read
+func parseErrQueue(oob []byte) (ICMPMessage, error) {
+	cmsgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return ICMPMessage{}, err
+	}
+	for _, cmsg := range cmsgs {
+		if (cmsg.Header.Level == syscall.IPPROTO_IP && cmsg.Header.Type == syscall.IP_RECVERR) ||
+			(cmsg.Header.Level == syscall.IPPROTO_IPV6 && cmsg.Header.Type == syscall.IPV6_RECVERR) {
+			return parseExtendedErr(cmsg.Data)
+		}
+	}
+	return ICMPMessage{}, errors.New("No ICMP error in the error queue")
+}
+
+// Decode a struct sock_extended_err, and the offender's address that follows it
+func parseExtendedErr(b []byte) (ICMPMessage, error) {
+	if len(b) < sizeofExtendedErr {
+		return ICMPMessage{}, errors.New("Short extended error")
+	}
+	origin := b[4]
+	if origin != SO_EE_ORIGIN_ICMP && origin != SO_EE_ORIGIN_ICMP6 {
+		return ICMPMessage{}, fmt.Errorf("Extended error is not from ICMP (origin %d)", origin)
+	}
+	msg := ICMPMessage{msgtype: b[5], code: int8(b[6]), v6: origin == SO_EE_ORIGIN_ICMP6, id: -1, seq: -1}
+	info := int(*(*uint32)(unsafe.Pointer(&b[8])))
+	msg.desc = icmpErrorDesc(msg.v6, msg.msgtype, msg.code)
+	if (msg.v6 && msg.msgtype == ICMP6_PACKET_TOO_BIG) || (!msg.v6 && msg.msgtype == ICMP4_DEST_UNREACHABLE && msg.code == 4) {
+		msg.mtu = info
+		msg.desc += fmt.Sprintf(" Next hop MTU %d.", msg.mtu)
+	}
+
+	// SO_EE_OFFENDER, a sockaddr_in or sockaddr_in6
+	sa := b[sizeofExtendedErr:]
+	if len(sa) >= 8 && *(*uint16)(unsafe.Pointer(&sa[0])) == syscall.AF_INET {
+		msg.from = net.IP(sa[4:8]).String()
+	} else if len(sa) >= 24 && *(*uint16)(unsafe.Pointer(&sa[0])) == syscall.AF_INET6 {
+		msg.from = net.IP(sa[8:24]).String()
+	}
+	return msg, nil
+}
@@ -0,0 +1,141 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// A struct sock_extended_err, as the kernel hands it back from the error queue
+func extendedErr(origin, msgtype, code uint8, info uint32, offender []byte) []byte {
+	data := make([]byte, sizeofExtendedErr+len(offender))
+	data[4], data[5], data[6] = origin, msgtype, code
+	*(*uint32)(unsafe.Pointer(&data[8])) = info
+	copy(data[sizeofExtendedErr:], offender)
+	return data
+}
+
+// Wrap data in a control message
+func controlMessage(level, typ int32, data []byte) []byte {
+	b := make([]byte, syscall.CmsgSpace(len(data)))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level, h.Type = level, typ
+	h.SetLen(syscall.CmsgLen(len(data)))
+	copy(b[syscall.CmsgLen(0):], data)
+	return b
+}
+
+// A sockaddr_in or sockaddr_in6 for the host that sent the ICMP error
+func offenderAddr(ip string) []byte {
+	addr := net.ParseIP(ip)
+	if addr.To4() != nil {
+		sa := make([]byte, syscall.SizeofSockaddrInet4)
+		*(*uint16)(unsafe.Pointer(&sa[0])) = syscall.AF_INET
+		copy(sa[4:8], addr.To4())
+		return sa
+	}
+	sa := make([]byte, syscall.SizeofSockaddrInet6)
+	*(*uint16)(unsafe.Pointer(&sa[0])) = syscall.AF_INET6
+	copy(sa[8:24], addr)
+	return sa
+}
+
+func TestParseErrQueue(t *testing.T) {
+	v4 := func(data []byte) []byte { return controlMessage(syscall.IPPROTO_IP, syscall.IP_RECVERR, data) }
+	v6 := func(data []byte) []byte { return controlMessage(syscall.IPPROTO_IPV6, syscall.IPV6_RECVERR, data) }
+	portUnreach4 := v4(extendedErr(SO_EE_ORIGIN_ICMP, ICMP4_DEST_UNREACHABLE, 3, 0, offenderAddr("192.0.2.1")))
+	portUnreach6 := v6(extendedErr(SO_EE_ORIGIN_ICMP6, ICMP6_DEST_UNREACHABLE, 4, 0, offenderAddr("2001:db8::1")))
+	tooBig6 := v6(extendedErr(SO_EE_ORIGIN_ICMP6, ICMP6_PACKET_TOO_BIG, 0, 1280, offenderAddr("2001:db8::1")))
+	local := v4(extendedErr(1, 0, 0, 0, nil)) // SO_EE_ORIGIN_LOCAL
+	short := v4(portUnreach4[syscall.CmsgLen(0) : syscall.CmsgLen(0)+8])
+	other := controlMessage(syscall.SOL_SOCKET, syscall.SCM_TIMESTAMP, make([]byte, 16))
+
+	var tests = []struct {
+		Oob         []byte
+		From        string
+		Unreachable bool
+		MTU         int
+		Desc        string
+		Err         string
+	}{
+		{portUnreach4, "192.0.2.1", true, 0, "Port unreachable error", ""},
+		{portUnreach6, "2001:db8::1", true, 0, "Port unreachable", ""},
+		{tooBig6, "2001:db8::1", false, 1280, "Packet too big. Next hop MTU 1280.", ""},
+		{local, "", false, 0, "", "Extended error is not from ICMP (origin 1)"},
+		{short, "", false, 0, "", "Short extended error"},
+		{portUnreach4[:len(portUnreach4)-8], "", false, 0, "", "invalid argument"},
+		{other, "", false, 0, "", "No ICMP error in the error queue"},
+	}
+	for count, test := range tests {
+		msg, err := parseErrQueue(test.Oob)
+		if test.Err != "" {
+			if err == nil || err.Error() != test.Err {
+				t.Fatalf("Line %d should have failed with %q, got %v", count+1, test.Err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Line %d failed to parse: %v", count+1, err)
+		}
+		if msg.from != test.From || msg.unreachable() != test.Unreachable || msg.mtu != test.MTU || !strings.HasPrefix(msg.desc, test.Desc) {
+			t.Fatalf("Line %d parsed incorrectly: %+v", count+1, msg)
+		}
+	}
+}
+
+// A real port unreachable from the loopback interface, through to the state of the subtest
+func TestReadErrQueue(t *testing.T) {
+	closed, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raddr := closed.LocalAddr().(*net.UDPAddr)
+	closed.Close()
+
+	conn, err := net.DialUDP("udp4", nil, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = enableRecvErr(conn); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte("ping"))
+	_, err = conn.Read(make([]byte, 16))
+	if err == nil {
+		t.Fatal("Read from a closed port succeeded")
+	}
+
+	var test SubTest
+	recordUDPError(&test, conn, err, "UDP")
+	if test.state != StateRejected || !test.refused || !strings.HasPrefix(test.error, "UDP Port unreachable error") {
+		t.Fatalf("Port unreachable recorded incorrectly: %s", fmtSubTest(test))
+	}
+	if _, err = readErrQueue(conn); err == nil {
+		t.Fatal("Error queue should be empty once read")
+	}
+}
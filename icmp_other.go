@@ -0,0 +1,38 @@
+//go:build !linux
+// +build !linux
+
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// The socket error queue is Linux only. Elsewhere we make do with ECONNREFUSED for port unreachables.
+func enableRecvErr(conn *net.UDPConn) error {
+	return errors.New("IP_RECVERR not supported on this platform")
+}
+
+func readErrQueue(conn *net.UDPConn) (ICMPMessage, error) {
+	return ICMPMessage{}, errors.New("No error queue on this platform")
+}
@@ -0,0 +1,96 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMakeICMPEcho(t *testing.T) {
+	b := makeICMPEcho(ICMP4_ECHO_REQUEST, 0x1234, 7, []byte("conchk test packet"))
+	if icmpChecksum(b) != 0 {
+		t.Fatalf("Echo request checksum does not verify: %v", b)
+	}
+	id, seq := parseICMPEchoReply(b)
+	if id != 0x1234 || seq != 7 {
+		t.Fatalf("Echo request id/seq mangled: %d!=%d or %d!=%d", 0x1234, id, 7, seq)
+	}
+}
+
+func TestParseICMPv4Unreachable(t *testing.T) {
+	// port unreachable for a UDP datagram 10.0.0.1:1025 -> 10.0.0.2:53
+	raw := []byte{ICMP4_DEST_UNREACHABLE, 3, 0, 0, 0, 0, 0, 0,
+		0x45, 0, 0, 28, 0, 0, 0, 0, 64, 17, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2,
+		0x04, 0x01, 0x00, 0x35, 0, 8, 0, 0}
+	msg, err := parseICMP(false, &net.IPAddr{IP: net.ParseIP("10.0.0.2")}, raw)
+	if err != nil {
+		t.Fatal("Failed to parse unreachable:", err)
+	}
+	if msg.originalLAddr != "10.0.0.1:1025" || msg.originalRAddr != "10.0.0.2:53" || msg.originalProto != "UDP" || msg.from != "10.0.0.2" {
+		t.Fatalf("Unreachable decoded incorrectly: %+v", msg)
+	}
+	if msg.id != -1 {
+		t.Fatalf("UDP datagram decoded as an echo request: %+v", msg)
+	}
+}
+
+func TestParseICMPv6Unreachable(t *testing.T) {
+	// port unreachable for a UDP datagram [2001:db8::1]:1025 -> [2001:db8::2]:123, via a destination options header
+	raw := []byte{ICMP6_DEST_UNREACHABLE, 4, 0, 0, 0, 0, 0, 0,
+		0x60, 0, 0, 0, 0, 24, 60, 64,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+		17, 0, 1, 4, 0, 0, 0, 0,
+		0x04, 0x01, 0x00, 0x7b, 0, 8, 0, 0}
+	msg, err := parseICMP(true, &net.IPAddr{IP: net.ParseIP("2001:db8::2")}, raw)
+	if err != nil {
+		t.Fatal("Failed to parse unreachable:", err)
+	}
+	if msg.originalLAddr != "[2001:db8::1]:1025" || msg.originalRAddr != "[2001:db8::2]:123" || msg.originalProto != "UDP" || !msg.unreachable() {
+		t.Fatalf("Unreachable decoded incorrectly: %+v", msg)
+	}
+
+	// and make sure a time exceeded doesn't get mistaken for an ICMPv4 unreachable
+	raw[0], raw[1] = ICMP6_TIME_EXCEEDED, 0
+	msg, err = parseICMP(true, &net.IPAddr{IP: net.ParseIP("2001:db8::2")}, raw)
+	if err != nil || msg.unreachable() {
+		t.Fatalf("Time exceeded decoded incorrectly: %+v %v", msg, err)
+	}
+}
+
+func TestPingInterval(t *testing.T) {
+	var tests = []struct {
+		Timeout  time.Duration
+		Interval time.Duration
+	}{
+		{3 * time.Second, time.Second},
+		{5 * time.Second, 5 * time.Second / 3},
+		{2 * time.Millisecond, MinPingInterval},
+		{time.Nanosecond, MinPingInterval}, // the ticker panics on 0
+	}
+	for count, test := range tests {
+		if interval := pingInterval(test.Timeout); interval != test.Interval {
+			t.Fatalf("Line %d timeout %s should ping every %s, got %s", count+1, test.Timeout, test.Interval, interval)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/droundy/goopt"
+	"os"
+	"time"
+)
+
+// The results of a run for --outputjson: everything the log shows, including each subTest, for dashboards and the
+// like to read instead of the log. Tests for other hosts (or --tags) aren't included. Times are in milliseconds.
+type jsonResults struct {
+	Host    string           `json:"host"`
+	Version string           `json:"version"`
+	Start   time.Time        `json:"start"`
+	End     time.Time        `json:"end"`
+	Tests   int              `json:"tests"`
+	Passed  int              `json:"passed"`
+	Results []jsonTestResult `json:"results"`
+}
+
+// The same names as a JSON test file uses, where there's one
+type jsonTestResult struct {
+	Ref         string              `json:"ref"`
+	Description string              `json:"description"`
+	Host        string              `json:"host"`
+	Local       string              `json:"local,omitempty"`
+	LocalDesc   string              `json:"local_description,omitempty"`
+	RemoteHost  string              `json:"remote_host,omitempty"`
+	Remote      string              `json:"remote"`
+	RemoteDesc  string              `json:"remote_description,omitempty"`
+	Protocol    string              `json:"protocol"`
+	Options     []string            `json:"options,omitempty"`
+	Result      string              `json:"result"` // PASSED, FAILED, ASYMMETRIC or PENDING
+	Passed      bool                `json:"passed"`
+	Error       string              `json:"error,omitempty"`
+	Start       *time.Time          `json:"start,omitempty"`
+	Elapsed     float64             `json:"elapsed_ms"`
+	RTT         float64             `json:"rtt_ms,omitempty"` // the average of the subTests that measure it
+	SubTests    []jsonSubTestResult `json:"subtests"`
+}
+
+type jsonSubTestResult struct {
+	Ref        string  `json:"ref,omitempty"`
+	Protocol   string  `json:"protocol"`
+	Local      string  `json:"local,omitempty"`
+	Remote     string  `json:"remote"`
+	RemoteName string  `json:"remote_name,omitempty"` // for resolve=all
+	LocalUsed  string  `json:"local_used,omitempty"`
+	RemoteUsed string  `json:"remote_used,omitempty"`
+	IPv6       bool    `json:"ipv6"`
+	Result     string  `json:"result"`
+	Passed     bool    `json:"passed"`
+	Refused    bool    `json:"refused"`
+	State      string  `json:"state,omitempty"`
+	RTT        float64 `json:"rtt_ms,omitempty"`
+	Attempts   int     `json:"attempts"`
+	Info       string  `json:"info,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+func newJSONResults(host string, start, end time.Time, tests []Test) *jsonResults {
+	results := &jsonResults{Host: host, Version: goopt.Version, Start: start, End: end, Results: []jsonTestResult{}}
+	for _, test := range tests {
+		if !test.attempt {
+			continue
+		}
+		results.Tests++
+		if test.passed {
+			results.Passed++
+		}
+		result := jsonTestResult{
+			Ref:         test.ref,
+			Description: test.desc,
+			Host:        test.lhost,
+			Local:       test.laddr,
+			LocalDesc:   test.ldesc,
+			RemoteHost:  test.rhost,
+			Remote:      test.raddr,
+			RemoteDesc:  test.rdesc,
+			Protocol:    test.net,
+			Result:      testResult(test),
+			Passed:      test.passed,
+			Error:       test.error,
+			Elapsed:     millis(test.elapsed),
+			RTT:         millis(testRTT(test)),
+			SubTests:    []jsonSubTestResult{},
+		}
+		if test.opts != nil {
+			result.Options = test.opts.raw
+		}
+		if test.run {
+			start := test.start
+			result.Start = &start
+		}
+		for subTestV := test.subTests.Front(); subTestV != nil; subTestV = subTestV.Next() {
+			subTest := subTestV.Value.(*SubTest)
+			result.SubTests = append(result.SubTests, jsonSubTestResult{
+				Ref:        subTest.subref,
+				Protocol:   subTest.net,
+				Local:      subTest.laddr,
+				Remote:     subTest.raddr,
+				RemoteName: subTest.rname,
+				LocalUsed:  subTest.laddr_used,
+				RemoteUsed: subTest.raddr_used,
+				IPv6:       subTest.ipv6,
+				Result:     subTestResult(*subTest),
+				Passed:     subTest.passed,
+				Refused:    subTest.refused,
+				State:      subTest.state,
+				RTT:        millis(subTest.rtt),
+				Attempts:   subTest.attempts,
+				Info:       subTest.info,
+				Error:      subTest.error,
+			})
+		}
+		results.Results = append(results.Results, result)
+	}
+	return results
+}
+
+func (results *jsonResults) write(name string) error {
+	out, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(out, '\n'), 0644)
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,63 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJSONResults(t *testing.T) {
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	opts, _ := parseTestOptions([]string{"pass=any"})
+	tests := []Test{
+		{ref: "1", desc: "web", lhost: "web01", raddr: "10.0.0.1:80-81", net: "tcp4", attempt: true, run: true, passed: true, start: start, elapsed: 1500 * time.Microsecond, opts: opts},
+		{ref: "2", desc: "someone else's", lhost: "db01", raddr: "10.0.0.2:5432", net: "tcp4", opts: opts},
+	}
+	tests[0].subTests.PushBack(&SubTest{subref: "1.1", raddr: "10.0.0.1:80", net: "tcp4", raddr_used: "10.0.0.1:80", run: true, passed: true, state: StateAnswered, rtt: 2 * time.Millisecond, attempts: 1})
+	tests[0].subTests.PushBack(&SubTest{subref: "1.2", raddr: "10.0.0.1:81", net: "tcp4", run: true, state: StateSilent, error: "timeout", attempts: 3})
+
+	name := filepath.Join(t.TempDir(), "results.json")
+	if err := newJSONResults("web01", start, start.Add(time.Second), tests).write(name); err != nil {
+		t.Fatal("Failed to write results:", err)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal("Failed to read results back:", err)
+	}
+	var results jsonResults
+	if err := json.Unmarshal(data, &results); err != nil {
+		t.Fatal("Results aren't valid JSON:", err)
+	}
+	if results.Host != "web01" || !results.End.Equal(start.Add(time.Second)) || results.Tests != 1 || results.Passed != 1 || len(results.Results) != 1 {
+		t.Fatalf("Run details are wrong: %+v", results)
+	}
+	test := results.Results[0]
+	if test.Ref != "1" || test.Result != "PASSED" || test.Elapsed != 1.5 || test.RTT != 2 || test.Start == nil || len(test.Options) != 1 || len(test.SubTests) != 2 {
+		t.Fatalf("Test details are wrong: %+v", test)
+	}
+	if sub := test.SubTests[1]; sub.Ref != "1.2" || sub.Result != "FAILED" || sub.State != StateSilent || sub.Error != "timeout" || sub.Attempts != 3 {
+		t.Fatalf("Subtest details are wrong: %+v", sub)
+	}
+}
@@ -0,0 +1,139 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A test file in JSON, as an alternative to the CSV columns:
+//
+//	{"groups": {"dmz": ["web01", "web-*"]},
+//	 "tests": [
+//		{"ref": "1", "description": "DNS to the resolver", "host": "@dmz", "remote": "10.0.0.53",
+//		 "protocol": "dns4", "tags": ["dmz"], "options": {"qname": "example.com", "answer": ["192.0.2.1"]}}
+//	]}
+//
+// Each test becomes the same record a CSV line would, so the two formats can't drift apart. expect, payload, tags
+// and everything in options become key=value options.
+type jsonTestFile struct {
+	Groups map[string][]string `json:"groups"` // host groups, for @name in host
+	Tests  []jsonTest          `json:"tests"`
+}
+
+type jsonTest struct {
+	Ref         string                     `json:"ref"`
+	Description string                     `json:"description"`
+	Host        string                     `json:"host"`
+	Local       string                     `json:"local"`
+	LocalDesc   string                     `json:"local_description"`
+	RemoteHost  string                     `json:"remote_host"`
+	Remote      string                     `json:"remote"`
+	RemoteDesc  string                     `json:"remote_description"`
+	Protocol    string                     `json:"protocol"`
+	Expect      string                     `json:"expect"`
+	Payload     string                     `json:"payload"`
+	Tags        []string                   `json:"tags"`
+	Options     map[string]json.RawMessage `json:"options"`
+}
+
+// Options that can be given more than once. A JSON array for one of these repeats the option, for anything else
+// the values are joined with commas, e.g. "alpn": ["h2", "http/1.1"].
+var repeatableOptions = map[string]bool{"answer": true, "header": true}
+
+// Read a JSON test file into the same records the CSV reader produces, and any host groups it defines
+func readJSONTests(r io.Reader) ([][]string, map[string][]string, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields() // a misspelt field would otherwise be silently ignored
+	var file jsonTestFile
+	if err := dec.Decode(&file); err != nil {
+		return nil, nil, err
+	}
+
+	records := make([][]string, 0, len(file.Tests))
+	for i, test := range file.Tests {
+		if test.Host == "" || test.Remote == "" || test.Protocol == "" {
+			return nil, nil, fmt.Errorf("test %d (ref %q) needs at least host, remote and protocol", i+1, test.Ref)
+		}
+		record := []string{test.Ref, test.Description, test.Host, test.Local, test.LocalDesc,
+			test.RemoteHost, test.Remote, test.RemoteDesc, test.Protocol, "", ""}
+		if test.Expect != "" {
+			record = append(record, "expect="+test.Expect)
+		}
+		if test.Payload != "" {
+			record = append(record, "payload="+test.Payload)
+		}
+		if len(test.Tags) > 0 {
+			record = append(record, "tags="+strings.Join(test.Tags, ","))
+		}
+
+		keys := make([]string, 0, len(test.Options))
+		for key := range test.Options {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			values, err := jsonOptionValues(test.Options[key])
+			if err != nil {
+				return nil, nil, fmt.Errorf("test %d (ref %q) option %s: %v", i+1, test.Ref, key, err)
+			}
+			if !repeatableOptions[key] {
+				values = []string{strings.Join(values, ",")}
+			}
+			for _, value := range values {
+				record = append(record, key+"="+value)
+			}
+		}
+		records = append(records, record)
+	}
+	return records, file.Groups, nil
+}
+
+// An option's value as strings: a string, number or boolean gives one, an array of them one each
+func jsonOptionValues(raw json.RawMessage) ([]string, error) {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		list = []interface{}{v}
+	}
+	values := make([]string, 0, len(list))
+	for _, item := range list {
+		switch item := item.(type) {
+		case string:
+			values = append(values, item)
+		case float64:
+			values = append(values, strconv.FormatFloat(item, 'f', -1, 64))
+		case bool:
+			values = append(values, strconv.FormatBool(item))
+		default:
+			return nil, fmt.Errorf("%s is not a string, number, boolean or an array of them", raw)
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,60 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadJSONTests(t *testing.T) {
+	const file = `{"groups": {"dmz": ["web01", "web-*"]}, "tests": [
+		{"ref": "1", "host": "web01", "remote": "10.0.0.53", "remote_description": "resolver", "protocol": "dns4",
+		 "expect": "allow", "tags": ["dmz", "dns"],
+		 "options": {"qname": "example.com", "answer": ["192.0.2.1", "192.0.2.2"], "alpn": ["h2", "http/1.1"], "maxstratum": 3}}
+	]}`
+	records, groups, err := readJSONTests(strings.NewReader(file))
+	if err != nil {
+		t.Fatal("Failed to read valid tests:", err)
+	}
+	want := []string{"1", "", "web01", "", "", "", "10.0.0.53", "resolver", "dns4", "", "",
+		"expect=allow", "tags=dmz,dns", "alpn=h2,http/1.1", "answer=192.0.2.1", "answer=192.0.2.2", "maxstratum=3", "qname=example.com"}
+	if len(groups["dmz"]) != 2 {
+		t.Fatalf("Groups read incorrectly: %q", groups)
+	}
+	if len(records) != 1 || strings.Join(records[0], "|") != strings.Join(want, "|") {
+		t.Fatalf("Tests read incorrectly: %q", records)
+	}
+	if _, err = parseTestOptions(records[0][11:]); err != nil {
+		t.Fatal("Options from JSON don't parse:", err)
+	}
+
+	for _, bad := range []string{
+		`{"tests": [{"host": "web01", "remote": "10.0.0.53", "protocol": "dns4", "protocl": "dns6"}]}`,
+		`{"tests": [{"host": "web01", "remote": "10.0.0.53"}]}`,
+		`{"tests": [{"host": "web01", "remote": "10.0.0.53", "protocol": "dns4", "options": {"qname": {"a": 1}}}]}`,
+		`{"tests": [`,
+	} {
+		if _, _, err := readJSONTests(strings.NewReader(bad)); err == nil {
+			t.Fatal("Invalid tests accepted:", bad)
+		}
+	}
+}
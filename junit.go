@@ -0,0 +1,132 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/droundy/goopt"
+	"os"
+	"time"
+)
+
+// A JUnit XML report for --outputjunit, for CI systems to show which flows broke. Each test is a testcase, with its
+// subTests as properties, and those for other hosts (or --tags) are there as skipped.
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name       string           `xml:"name,attr"`
+	Hostname   string           `xml:"hostname,attr"`
+	Tests      int              `xml:"tests,attr"`
+	Failures   int              `xml:"failures,attr"`
+	Skipped    int              `xml:"skipped,attr"`
+	Time       string           `xml:"time,attr"`
+	Timestamp  string           `xml:"timestamp,attr"`
+	Properties *junitProperties `xml:"properties"`
+	Cases      []junitCase      `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name       string           `xml:"name,attr"`
+	Classname  string           `xml:"classname,attr"`
+	Time       string           `xml:"time,attr"`
+	Properties *junitProperties `xml:"properties"`
+	Failure    *junitMessage    `xml:"failure"`
+	Skipped    *junitMessage    `xml:"skipped"`
+}
+
+type junitProperties struct {
+	Property []junitProperty `xml:"property"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+func newJUnitReport(host string, start, end time.Time, tests []Test) *junitSuites {
+	suite := junitSuite{
+		Name:       "conchk",
+		Hostname:   host,
+		Time:       junitTime(end.Sub(start)),
+		Timestamp:  start.UTC().Format("2006-01-02T15:04:05"),
+		Properties: &junitProperties{[]junitProperty{{"version", goopt.Version}}},
+	}
+	for _, test := range tests {
+		tc := junitCase{
+			Name:      fmt.Sprintf("%s %s", test.ref, test.desc),
+			Classname: test.net,
+			Time:      junitTime(test.elapsed),
+		}
+		suite.Tests++
+		switch {
+		case !test.attempt:
+			suite.Skipped++
+			tc.Skipped = &junitMessage{Message: "not for this host, or not picked by --tags"}
+		case !test.run:
+			suite.Skipped++
+			tc.Skipped = &junitMessage{Message: "not run"}
+		case !test.passed:
+			suite.Failures++
+			tc.Failure = &junitMessage{Message: test.error, Type: testResult(test)}
+		}
+		if !test.attempt {
+			suite.Cases = append(suite.Cases, tc)
+			continue
+		}
+		tc.Properties = &junitProperties{}
+		for subTestV := test.subTests.Front(); subTestV != nil; subTestV = subTestV.Next() {
+			subTest := subTestV.Value.(*SubTest)
+			name := subTest.subref
+			if name == "" {
+				name = test.ref
+			}
+			tc.Properties.Property = append(tc.Properties.Property, junitProperty{name, subTestSummary(*subTest)})
+			if tc.Failure != nil {
+				tc.Failure.Text += name + " " + subTestSummary(*subTest) + "\n"
+			}
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+	return &junitSuites{Suites: []junitSuite{suite}}
+}
+
+func (report *junitSuites) write(name string) error {
+	out, err := xml.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append([]byte(xml.Header), append(out, '\n')...), 0644)
+}
+
+// JUnit times are in seconds
+func junitTime(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
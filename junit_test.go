@@ -0,0 +1,73 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJUnitReport(t *testing.T) {
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	tests := []Test{
+		{ref: "1", desc: "web", net: "tcp4", attempt: true, run: true, passed: true, elapsed: 1500 * time.Millisecond},
+		{ref: "2", desc: "db", net: "tcp4", attempt: true, run: true, error: "2.2 refused;"},
+		{ref: "3", desc: "someone else's", net: "udp4"},
+	}
+	tests[0].subTests.PushBack(&SubTest{raddr: "10.0.0.1:80", run: true, passed: true})
+	tests[1].subTests.PushBack(&SubTest{subref: "2.1", raddr: "10.0.0.2:5432", raddr_used: "10.0.0.2:5432", run: true, passed: true})
+	tests[1].subTests.PushBack(&SubTest{subref: "2.2", raddr: "10.0.0.3:5432", run: true, refused: true, state: StateRejected, error: "Connect error"})
+	tests[2].subTests.PushBack(&SubTest{raddr: "10.0.0.4:53"})
+
+	name := filepath.Join(t.TempDir(), "results.xml")
+	if err := newJUnitReport("web01", start, start.Add(2*time.Second), tests).write(name); err != nil {
+		t.Fatal("Failed to write the report:", err)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal("Failed to read the report back:", err)
+	}
+	var report junitSuites
+	if err := xml.Unmarshal(data, &report); err != nil {
+		t.Fatal("Report isn't valid XML:", err)
+	}
+	if len(report.Suites) != 1 {
+		t.Fatalf("Report should have one suite: %+v", report)
+	}
+	suite := report.Suites[0]
+	if suite.Hostname != "web01" || suite.Tests != 3 || suite.Failures != 1 || suite.Skipped != 1 || suite.Time != "2.000" || len(suite.Cases) != 3 {
+		t.Fatalf("Suite details are wrong: %+v", suite)
+	}
+	if tc := suite.Cases[0]; tc.Name != "1 web" || tc.Time != "1.500" || tc.Failure != nil || tc.Skipped != nil || tc.Properties.Property[0] != (junitProperty{"1", "10.0.0.1:80 PASSED"}) {
+		t.Fatalf("Passing testcase is wrong: %+v", tc)
+	}
+	tc := suite.Cases[1]
+	if tc.Failure == nil || tc.Failure.Message != "2.2 refused;" || tc.Failure.Type != "FAILED" || !strings.Contains(tc.Failure.Text, "2.2 10.0.0.3:5432 FAILED (rejected) Connect error") {
+		t.Fatalf("Failing testcase is wrong: %+v %+v", tc, tc.Failure)
+	}
+	if tc := suite.Cases[2]; tc.Skipped == nil || tc.Properties != nil {
+		t.Fatalf("Other host's testcase should be skipped: %+v", tc)
+	}
+}
@@ -0,0 +1,96 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Nagios plugin exit codes
+const (
+	NagiosOK       = 0
+	NagiosWarning  = 1
+	NagiosCritical = 2
+	NagiosUnknown  = 3
+)
+
+// The status line, perfdata and long output for --format=nagios, and the exit code to go with them.
+// Any failed test is CRITICAL. A dual test that only failed over one family, or a test that only passed on a retry,
+// is a WARNING: the flow works, but not as well as it should. No tests at all for this host is UNKNOWN.
+func nagiosReport(host string, tests []Test, elapsed time.Duration) (string, int) {
+	var run, passed int
+	var failed, asymmetric, retried, perfdata, details []string
+	for _, test := range tests {
+		if !test.attempt {
+			continue
+		}
+		run++
+		switch {
+		case test.passed:
+			passed++
+			if testAttempts(test) > 1 {
+				retried = append(retried, test.ref)
+			}
+		case test.asymmetric:
+			asymmetric = append(asymmetric, test.ref)
+			details = append(details, fmtTest(test))
+		default:
+			failed = append(failed, test.ref)
+			details = append(details, fmtTest(test))
+		}
+		if rtt := testRTT(test); rtt > 0 {
+			perfdata = append(perfdata, fmt.Sprintf("'%s rtt'=%.3fms", test.ref, millis(rtt)))
+		}
+	}
+	if run == 0 {
+		return fmt.Sprintf("CONCHK UNKNOWN - no tests for %s\n", host), NagiosUnknown
+	}
+
+	state, code := "OK", NagiosOK
+	switch {
+	case len(failed) > 0:
+		state, code = "CRITICAL", NagiosCritical
+	case len(asymmetric) > 0 || len(retried) > 0:
+		state, code = "WARNING", NagiosWarning
+	}
+	status := fmt.Sprintf("CONCHK %s - %d of %d tests passed", state, passed, run)
+	for _, refs := range []struct {
+		what string
+		refs []string
+	}{{"failed", failed}, {"asymmetric", asymmetric}, {"passed on a retry", retried}} {
+		if len(refs.refs) > 0 {
+			status += fmt.Sprintf(", %s: %s", refs.what, strings.Join(refs.refs, " "))
+		}
+	}
+	perfdata = append([]string{
+		fmt.Sprintf("passed=%d;;;0;%d", passed, run),
+		fmt.Sprintf("failed=%d;;;0;%d", run-passed, run),
+		fmt.Sprintf("time=%.3fs", elapsed.Seconds()),
+	}, perfdata...)
+
+	out := status + " | " + strings.Join(perfdata, " ") + "\n"
+	for _, line := range details {
+		out += strings.ReplaceAll(line, "|", "/") + "\n" // | starts perfdata, even in the long output
+	}
+	return out, code
+}
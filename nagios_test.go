@@ -0,0 +1,63 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNagiosReport(t *testing.T) {
+	var tests = []struct {
+		Results string // P passed, p passed on a retry, F failed, A asymmetric, - someone else's
+		Code    int
+		Status  string
+	}{
+		{"PP-", NagiosOK, "CONCHK OK - 2 of 2 tests passed | passed=2;;;0;2 failed=0;;;0;2 time=1.000s '1 rtt'=2.000ms '2 rtt'=2.000ms"},
+		{"Pp", NagiosWarning, "CONCHK WARNING - 2 of 2 tests passed, passed on a retry: 2 |"},
+		{"PA", NagiosWarning, "CONCHK WARNING - 1 of 2 tests passed, asymmetric: 2 |"},
+		{"FAp", NagiosCritical, "CONCHK CRITICAL - 1 of 3 tests passed, failed: 1, asymmetric: 2, passed on a retry: 3 | passed=1;;;0;3 failed=2;;;0;3"},
+		{"--", NagiosUnknown, "CONCHK UNKNOWN - no tests for web01"},
+	}
+	for count, test := range tests {
+		var tt []Test
+		for i, r := range test.Results {
+			result := Test{ref: string(rune('1' + i)), net: "tcp4", attempt: r != '-', run: r != '-', passed: r == 'P' || r == 'p', asymmetric: r == 'A'}
+			subTest := &SubTest{run: true, passed: result.passed, rtt: 2 * time.Millisecond, attempts: 1}
+			if r == 'p' {
+				subTest.attempts = 2
+			}
+			if !result.passed {
+				result.error = "bad | worse"
+			}
+			result.subTests.PushBack(subTest)
+			tt = append(tt, result)
+		}
+		status, code := nagiosReport("web01", tt, time.Second)
+		if code != test.Code || !strings.HasPrefix(status, test.Status) {
+			t.Fatalf("Line %d %s should have been %d %q, got %d %q", count+1, test.Results, test.Code, test.Status, code, status)
+		}
+		if lines := strings.Split(strings.TrimSpace(status), "\n"); code != NagiosUnknown && (strings.Count(status, "|") != 1 || len(lines) != 1+strings.Count(test.Results, "F")+strings.Count(test.Results, "A")) {
+			t.Fatalf("Line %d %s has the wrong long output: %q", count+1, test.Results, status)
+		}
+	}
+}
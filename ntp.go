@@ -0,0 +1,142 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	NTPPacketLen = 48
+	NTPEpochDiff = 2208988800 // seconds from 1900 to 1970
+)
+
+// NTP probe. Sends an SNTP client (mode 3) request and checks for a sane server (mode 4) reply to it.
+// afnet is ntp, ntp4 or ntp6
+func runNTPTest(afnet string, test *SubTest, p *ICMPPublisher) {
+	debug.Println("Doing NTP test")
+
+	test.raddr = withDefaultPort(test.raddr, "123")
+	test.run = true
+	conn, err := dialSubTest("udp"+strings.TrimPrefix(afnet, "ntp"), test)
+	if err != nil {
+		test.state = connectErrorState(err)
+		test.refused = isConnRefused(err)
+		test.error = "NTP Dial error: " + err.Error()
+		return
+	}
+	defer conn.Close()
+	enableRecvErr(conn.(*net.UDPConn))
+
+	conn.SetDeadline(time.Now().Add(testTimeout(test.opts)))
+
+	request := make([]byte, NTPPacketLen)
+	request[0] = 4<<3 | 3 // LI 0, version 4, mode 3 (client)
+	t1 := time.Now()
+	putNTPTime(request[40:], t1)
+	if _, err = conn.Write(request); err != nil {
+		recordUDPError(test, conn.(*net.UDPConn), err, "NTP")
+		return
+	}
+
+	reply := make([]byte, 1500)
+	var n int
+	var t4 time.Time
+	for {
+		n, err = conn.Read(reply)
+		t4 = time.Now()
+		if err != nil {
+			recordUDPError(test, conn.(*net.UDPConn), err, "NTP")
+			return
+		}
+		// a reply to something else, or a spoof, won't have our transmit time as its origin time
+		if n >= NTPPacketLen && string(reply[24:32]) == string(request[40:48]) {
+			break
+		}
+		debug.Println("Ignoring NTP packet that isn't a reply to our request")
+	}
+	test.state = StateAnswered
+
+	stratum, offset, delay, err := parseNTPReply(reply[:n], t1, t4)
+	if err != nil {
+		test.error = "NTP reply error: " + err.Error()
+		return
+	}
+	test.rtt = delay
+	test.info = fmt.Sprintf("stratum %d, offset %v", stratum, offset)
+
+	if test.opts.ntpMaxStratum > 0 && stratum > test.opts.ntpMaxStratum {
+		test.error = fmt.Sprintf("Stratum %d is above the maximum of %d", stratum, test.opts.ntpMaxStratum)
+		return
+	}
+	if test.opts.ntpMaxOffset > 0 && (offset > test.opts.ntpMaxOffset || offset < -test.opts.ntpMaxOffset) {
+		test.error = fmt.Sprintf("Offset %v is more than the maximum of %v", offset, test.opts.ntpMaxOffset)
+		return
+	}
+	test.passed = true
+	debug.Println("*****Completed: ", fmtSubTest(*test))
+}
+
+// Check the reply is a usable server response, and work out the clock offset and round trip delay as per RFC 4330.
+// t1 is when we sent the request, t4 when the reply arrived.
+func parseNTPReply(b []byte, t1, t4 time.Time) (stratum int, offset, delay time.Duration, err error) {
+	if len(b) < NTPPacketLen {
+		return 0, 0, 0, fmt.Errorf("short reply of %d bytes", len(b))
+	}
+	if mode := b[0] & 0x07; mode != 4 {
+		return 0, 0, 0, fmt.Errorf("reply is mode %d, not a server reply", mode)
+	}
+	if b[0]>>6 == 3 {
+		return 0, 0, 0, fmt.Errorf("server clock is not synchronised")
+	}
+	stratum = int(b[1])
+	if stratum == 0 {
+		return 0, 0, 0, fmt.Errorf("kiss of death %q", strings.TrimRight(string(b[12:16]), "\x00"))
+	}
+	t2 := getNTPTime(b[32:])
+	t3 := getNTPTime(b[40:])
+	if t3.IsZero() {
+		return 0, 0, 0, fmt.Errorf("reply has no transmit time")
+	}
+	offset = (t2.Sub(t1) + t3.Sub(t4)) / 2
+	delay = t4.Sub(t1) - t3.Sub(t2)
+	return
+}
+
+func putNTPTime(b []byte, t time.Time) {
+	secs := uint64(t.Unix()) + NTPEpochDiff
+	frac := uint64(t.Nanosecond()) << 32 / 1e9
+	binary.BigEndian.PutUint32(b[0:], uint32(secs))
+	binary.BigEndian.PutUint32(b[4:], uint32(frac))
+}
+
+func getNTPTime(b []byte) time.Time {
+	secs := binary.BigEndian.Uint32(b[0:])
+	frac := binary.BigEndian.Uint32(b[4:])
+	if secs == 0 && frac == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(secs)-NTPEpochDiff, int64(uint64(frac)*1e9>>32))
+}
@@ -0,0 +1,102 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNTPTime(t *testing.T) {
+	now := time.Unix(1366000000, 123456789)
+	b := make([]byte, 8)
+	putNTPTime(b, now)
+	back := getNTPTime(b)
+	if diff := back.Sub(now); diff > time.Microsecond || diff < -time.Microsecond {
+		t.Fatalf("NTP time round trip is out by %v", diff)
+	}
+}
+
+func TestParseNTPReply(t *testing.T) {
+	t1 := time.Unix(1366000000, 0)
+	t4 := t1.Add(100 * time.Millisecond)
+	// the server's clock is 2s ahead, and it took 20ms to answer
+	reply := make([]byte, NTPPacketLen)
+	reply[0], reply[1] = 4<<3|4, 2
+	putNTPTime(reply[32:], t1.Add(2*time.Second+40*time.Millisecond))
+	putNTPTime(reply[40:], t1.Add(2*time.Second+60*time.Millisecond))
+
+	stratum, offset, delay, err := parseNTPReply(reply, t1, t4)
+	if err != nil {
+		t.Fatal("Failed to parse reply:", err)
+	}
+	if stratum != 2 || offset.Round(time.Millisecond) != 2*time.Second || delay.Round(time.Millisecond) != 80*time.Millisecond {
+		t.Fatalf("Reply decoded incorrectly: stratum %d offset %v delay %v", stratum, offset, delay)
+	}
+
+	reply[1] = 0
+	copy(reply[12:], "RATE")
+	if _, _, _, err = parseNTPReply(reply, t1, t4); err == nil {
+		t.Fatal("Kiss of death accepted")
+	}
+	reply[0], reply[1] = 4<<3|3, 2
+	if _, _, _, err = parseNTPReply(reply, t1, t4); err == nil {
+		t.Fatal("Client mode packet accepted as a reply")
+	}
+}
+
+// A closed port and a server that never answers should both count as blocked for expect=deny
+func TestNTPBlocked(t *testing.T) {
+	silent, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	closed, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	var tests = []struct {
+		Raddr string
+		State string
+	}{
+		{closed.LocalAddr().String(), StateRejected},
+		{silent.LocalAddr().String(), StateSilent},
+	}
+	for count, test := range tests {
+		opts, err := parseTestOptions([]string{"expect=deny", "timeout=200ms"})
+		if err != nil {
+			t.Fatalf("Line %d options rejected: %v", count+1, err)
+		}
+		subTest := SubTest{net: "ntp4", raddr: test.Raddr, opts: opts}
+		runNTPTest("ntp4", &subTest, nil)
+		if subTest.state != test.State {
+			t.Fatalf("Line %d should have been %s: %s", count+1, test.State, fmtSubTest(subTest))
+		}
+		checkExpectation(&subTest, opts.expect)
+		if !subTest.passed {
+			t.Fatalf("Line %d should have passed with expect=deny: %s", count+1, fmtSubTest(subTest))
+		}
+	}
+}
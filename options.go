@@ -0,0 +1,377 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Optional per-test settings. These live in the columns after Summary, one key=value per column, so that they
+// survive a trip through --outputcsv without the positional columns growing any further.
+type TestOptions struct {
+	raw        []string         // as read, so they can be written out again
+	expect     string           // what should happen to the flow, ExpectAllow etc
+	policy     PassPolicy       // how many subtests must pass
+	resolveAll bool             // test every address the remote host resolves to
+	timeout    time.Duration    // overrides --timeout, if set
+	retries    int              // how many more times to try a subtest that fails
+	backoff    time.Duration    // wait before the first retry, doubled for each one after
+	traceroute *bool            // overrides --traceroute, if set
+	tags       []string         // for picking tests to run with --tags
+	payload    []byte           // UDP datagram to send, instead of the default
+	payloadSrc string           // file to read payload from, in loadFiles
+	response   *ResponseMatcher // if set, a UDP test only passes if a reply matches
+
+	dnsName    string   // query name for dns tests
+	dnsType    uint16   // query type for dns tests
+	dnsRcode   int      // expected RCODE for dns tests, -1 for any
+	dnsAnswers []string // values that must all be in the answer section for dns tests
+
+	ntpMaxStratum int           // ntp tests fail if the server's stratum is higher, if set
+	ntpMaxOffset  time.Duration // ntp tests fail if our clock is further out than this, if set
+
+	tlsServerName  string         // SNI, and the name the certificate must match. Defaults to the remote host name
+	tlsALPN        []string       // protocols to offer. One of them must be negotiated, if set
+	tlsMinVersion  uint16         // lowest TLS version we'll accept
+	tlsRoots       *x509.CertPool // CA bundle the certificate must chain to, instead of the system roots
+	tlsCAFile      string         // file to read tlsRoots from, in loadFiles
+	tlsNoVerify    bool           // report, but don't fail on, an untrusted certificate
+	tlsMinValidity time.Duration  // certificates expiring within this are failed
+
+	httpMethod  string   // defaults to GET
+	httpPath    string   // defaults to /
+	httpHost    string   // Host header, defaults to the remote host
+	httpStatus  []string // acceptable status codes, e.g. 200 or 2xx. Defaults to anything below 400
+	httpHeaders []string // headers that must be present, as Name or Name: value
+	httpBody    string   // the body must contain this
+
+	sctpLAddrs []string // extra local addresses for multi-homed sctp tests
+	sctpRAddrs []string // extra remote addresses for multi-homed sctp tests
+
+	pmtuMin int // pmtu tests fail if the path MTU is lower, if set
+	pmtuMax int // largest packet pmtu tests try, defaults to 1500
+}
+
+const (
+	ExpectAllow  = "allow"  // the flow must work
+	ExpectDeny   = "deny"   // the flow must be blocked, one way or the other
+	ExpectReject = "reject" // the flow must be actively refused
+	ExpectDrop   = "drop"   // the flow must be silently dropped
+)
+
+// How many of a test's subTests (ports in a range, expanded destinations) must pass for the test to
+type PassPolicy struct {
+	rule      string // PassRange etc
+	atLeast   int    // for PassAtLeast
+	refusedOK bool   // refused subTests count as passed
+}
+
+const (
+	PassRange   = "range"  // one must pass, the rest may be refused. The default
+	PassAny     = "any"    // one must pass, whatever happens to the rest
+	PassAll     = "all"    // every one must pass
+	PassQuorum  = "quorum" // more than half must pass
+	PassAtLeast = "atleast"
+	PassNone    = "none" // none may pass
+)
+
+func (policy PassPolicy) String() string {
+	s := policy.rule
+	if policy.rule == PassAtLeast {
+		s = strconv.Itoa(policy.atLeast)
+	}
+	if policy.refusedOK {
+		s += ", refusedok"
+	}
+	return s
+}
+
+// range, any, all, quorum, none, or a number for at least that many
+func parsePassRule(value string) (PassPolicy, error) {
+	value = strings.ToLower(value)
+	switch value {
+	case PassRange, PassAny, PassAll, PassQuorum, PassNone:
+		return PassPolicy{rule: value}, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return PassPolicy{}, errors.New("pass must be range, any, all, quorum, none or a number of subtests")
+	}
+	return PassPolicy{rule: PassAtLeast, atLeast: n}, nil
+}
+
+// What a UDP reply must look like for the test to pass
+type ResponseMatcher struct {
+	spec  string // as configured, for error messages
+	kind  string // any, exact, prefix or regex
+	bytes []byte
+	re    *regexp.Regexp
+}
+
+func parseTestOptions(fields []string) (*TestOptions, error) {
+	opts := &TestOptions{expect: ExpectAllow, policy: PassPolicy{rule: PassRange}, backoff: DefaultBackoff}
+	passGiven := false
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		opts.raw = append(opts.raw, field)
+		i := strings.Index(field, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("option %q is not key=value", field)
+		}
+		key := strings.TrimSpace(field[:i])
+		if err := opts.set(key, strings.TrimSpace(field[i+1:])); err != nil {
+			return nil, fmt.Errorf("option %q: %v", field, err)
+		}
+		passGiven = passGiven || key == "pass"
+	}
+	if opts.resolveAll && !passGiven {
+		opts.policy.rule = PassAll // the point is to find the one address that doesn't work
+	}
+	return opts, nil
+}
+
+// Read the files the options name. This is only done for tests this host runs, as with one test file for every host
+// a file may well only exist on the host that needs it.
+func (opts *TestOptions) loadFiles() error {
+	var err error
+	if opts.payloadSrc != "" {
+		if opts.payload, err = os.ReadFile(opts.payloadSrc); err != nil {
+			return fmt.Errorf("option payload=file:%s: %v", opts.payloadSrc, err)
+		}
+	}
+	if opts.tlsCAFile != "" {
+		if opts.tlsRoots, err = loadCAFile(opts.tlsCAFile); err != nil {
+			return fmt.Errorf("option cafile=%s: %v", opts.tlsCAFile, err)
+		}
+	}
+	return nil
+}
+
+func (opts *TestOptions) set(key, value string) error {
+	var err error
+	switch key {
+	case "expect":
+		switch strings.ToLower(value) {
+		case ExpectAllow, ExpectDeny, ExpectReject, ExpectDrop:
+			opts.expect = strings.ToLower(value)
+		default:
+			err = errors.New("expect must be allow, deny, reject or drop")
+		}
+	case "pass":
+		refusedOK := opts.policy.refusedOK
+		opts.policy, err = parsePassRule(value)
+		opts.policy.refusedOK = refusedOK
+	case "resolve":
+		switch strings.ToLower(value) {
+		case "all":
+			opts.resolveAll = true
+		case "first":
+			opts.resolveAll = false
+		default:
+			err = errors.New("resolve must be all or first")
+		}
+	case "timeout":
+		if opts.timeout, err = time.ParseDuration(value); err == nil && opts.timeout <= 0 {
+			err = errors.New("timeout must be more than 0")
+		}
+	case "retries":
+		if opts.retries, err = strconv.Atoi(value); err == nil && (opts.retries < 0 || opts.retries > MaxRetries) {
+			err = fmt.Errorf("retries must be 0 to %d", MaxRetries)
+		}
+	case "backoff":
+		if opts.backoff, err = time.ParseDuration(value); err == nil && opts.backoff < 0 {
+			err = errors.New("backoff can't be negative")
+		}
+	case "refusedok":
+		opts.policy.refusedOK, err = parseBool(value)
+	case "traceroute":
+		var on bool
+		on, err = parseBool(value)
+		opts.traceroute = &on
+	case "tags":
+		opts.tags = strings.Split(value, ",")
+	case "payload":
+		opts.payload, opts.payloadSrc, err = parsePayload(value)
+	case "response":
+		opts.response, err = parseResponseMatcher(value)
+	case "qname":
+		opts.dnsName = value
+	case "qtype":
+		opts.dnsType, err = parseDNSType(value)
+	case "rcode":
+		opts.dnsRcode, err = parseDNSRcode(value)
+	case "answer":
+		opts.dnsAnswers = append(opts.dnsAnswers, value)
+	case "maxstratum":
+		opts.ntpMaxStratum, err = strconv.Atoi(value)
+	case "maxoffset":
+		opts.ntpMaxOffset, err = time.ParseDuration(value)
+	case "sni":
+		opts.tlsServerName = value
+	case "alpn":
+		opts.tlsALPN = strings.Split(value, ",")
+	case "tlsmin":
+		opts.tlsMinVersion, err = parseTLSVersion(value)
+	case "cafile":
+		opts.tlsCAFile = value
+	case "verify":
+		var verify bool
+		verify, err = parseBool(value)
+		opts.tlsNoVerify = !verify
+	case "minvalidity":
+		opts.tlsMinValidity, err = parseLongDuration(value)
+	case "method":
+		opts.httpMethod = strings.ToUpper(value)
+	case "path":
+		if !strings.HasPrefix(value, "/") {
+			err = errors.New("path must start with /")
+		}
+		opts.httpPath = value
+	case "host":
+		opts.httpHost = value
+	case "status":
+		opts.httpStatus = strings.Split(value, ",")
+	case "header":
+		opts.httpHeaders = append(opts.httpHeaders, value)
+	case "body":
+		opts.httpBody = value
+	case "laddrs":
+		opts.sctpLAddrs = strings.Split(value, ",")
+	case "raddrs":
+		opts.sctpRAddrs = strings.Split(value, ",")
+	case "minmtu":
+		opts.pmtuMin, err = strconv.Atoi(value)
+	case "maxmtu":
+		if opts.pmtuMax, err = strconv.Atoi(value); err == nil && opts.pmtuMax < 68 {
+			err = errors.New("maxmtu must be at least 68")
+		}
+	default:
+		err = errors.New("unknown option")
+	}
+	return err
+}
+
+// hex:<hex digits> or file:<path>. The file isn't read until loadFiles.
+func parsePayload(value string) ([]byte, string, error) {
+	kind, arg := splitKind(value)
+	switch kind {
+	case "hex":
+		payload, err := hex.DecodeString(arg)
+		return payload, "", err
+	case "file":
+		return nil, arg, nil
+	}
+	return nil, "", errors.New("payload must be hex:<hex> or file:<path>")
+}
+
+// any, exact:<hex>, prefix:<hex> or regex:<regexp>
+func parseResponseMatcher(value string) (*ResponseMatcher, error) {
+	m := &ResponseMatcher{spec: value}
+	var err error
+	m.kind, value = splitKind(value)
+	switch m.kind {
+	case "any":
+	case "exact", "prefix":
+		m.bytes, err = hex.DecodeString(value)
+	case "regex":
+		m.re, err = regexp.Compile(value)
+	default:
+		err = errors.New("response must be any, exact:<hex>, prefix:<hex> or regex:<regexp>")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *ResponseMatcher) match(reply []byte) bool {
+	switch m.kind {
+	case "exact":
+		return bytes.Equal(reply, m.bytes)
+	case "prefix":
+		return bytes.HasPrefix(reply, m.bytes)
+	case "regex":
+		return m.re.Match(reply)
+	}
+	return true
+}
+
+func (m *ResponseMatcher) String() string {
+	return m.spec
+}
+
+// Does the test have one of the comma separated tags? No tags at all selects every test.
+func (opts *TestOptions) hasTag(tags string) bool {
+	if tags == "" {
+		return true
+	}
+	for _, want := range strings.Split(tags, ",") {
+		for _, tag := range opts.tags {
+			if strings.TrimSpace(want) == strings.TrimSpace(tag) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// yes/no as well as the usual true/false etc
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes", "y":
+		return true, nil
+	case "no", "n":
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// A duration that also understands days, e.g. 14d, since certificate lifetimes are far too long for hours
+func parseLongDuration(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(value, "d"), 64)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(value)
+}
+
+func splitKind(value string) (kind, arg string) {
+	i := strings.Index(value, ":")
+	if i < 0 {
+		return value, ""
+	}
+	return value[:i], value[i+1:]
+}
@@ -0,0 +1,129 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseTestOptions(t *testing.T) {
+	opts, err := parseTestOptions([]string{" payload=hex:636f6e63686b", "", "response=prefix:636f6e"})
+	if err != nil {
+		t.Fatal("Failed to parse valid options:", err)
+	}
+	if string(opts.payload) != "conchk" || len(opts.raw) != 2 {
+		t.Fatalf("Options parsed incorrectly: %+v", opts)
+	}
+	if opts.retries != 0 || opts.backoff != DefaultBackoff {
+		t.Fatalf("Retry defaults are wrong: %+v", opts)
+	}
+
+	for _, bad := range []string{"payload", "payload=zz:00", "payload=hex:0g", "response=regex:(", "maxmtu=40", "pass=0", "pass=most", "refusedok=maybe", "timeout=0s", "timeout=5", "retries=-1", "retries=11", "backoff=-1s", "nosuchoption=1"} {
+		if _, err := parseTestOptions([]string{bad}); err == nil {
+			t.Fatal("Invalid option accepted:", bad)
+		}
+	}
+}
+
+// Files are only read once we know the test is ours, as they may not exist anywhere else
+func TestLoadFiles(t *testing.T) {
+	payload := filepath.Join(t.TempDir(), "payload.bin")
+	if err := os.WriteFile(payload, []byte("conchk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cafile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(cafile, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		Option  string
+		Payload string
+		Err     bool
+	}{
+		{"payload=hex:636f6e63686b", "conchk", false},
+		{"payload=file:" + payload, "conchk", false},
+		{"payload=file:" + payload + ".missing", "", true},
+		{"cafile=" + cafile + ".missing", "", true},
+		{"cafile=" + cafile, "", true}, // no certificates in it
+	}
+	for count, test := range tests {
+		opts, err := parseTestOptions([]string{test.Option})
+		if err != nil {
+			t.Fatalf("Line %d %s rejected before any file was read: %v", count+1, test.Option, err)
+		}
+		err = opts.loadFiles()
+		if (err != nil) != test.Err || string(opts.payload) != test.Payload {
+			t.Fatalf("Line %d %s should have loaded %q with error %v, got %q %v", count+1, test.Option, test.Payload, test.Err, opts.payload, err)
+		}
+	}
+}
+
+func TestHasTag(t *testing.T) {
+	var tests = []struct {
+		Tags   string
+		Option string
+		Match  bool
+	}{
+		{"", "", true},
+		{"", "tags=dmz", true},
+		{"dmz", "", false},
+		{"dmz", "tags=web,dmz", true},
+		{"web, dns", "tags=dns", true},
+		{"web", "tags=dmz,dns", false},
+	}
+	for count, test := range tests {
+		opts, err := parseTestOptions([]string{test.Option})
+		if err != nil {
+			t.Fatalf("Line %d failed to parse %s: %v", count+1, test.Option, err)
+		}
+		if opts.hasTag(test.Tags) != test.Match {
+			t.Fatalf("Line %d --tags %q for %q should be %v", count+1, test.Tags, test.Option, test.Match)
+		}
+	}
+}
+
+func TestResponseMatcher(t *testing.T) {
+	var tests = []struct {
+		Spec  string
+		Reply string
+		Match bool
+	}{
+		{"any", "", true},
+		{"exact:636f6e63686b", "conchk", true},
+		{"exact:636f6e63686b", "conchk!", false},
+		{"prefix:636f6e", "conchk!", true},
+		{"prefix:636f6e", "co", false},
+		{"regex:^SSH-2\\.0-", "SSH-2.0-OpenSSH", true},
+		{"regex:^SSH-2\\.0-", "HTTP/1.1 400", false},
+	}
+	for count, test := range tests {
+		m, err := parseResponseMatcher(test.Spec)
+		if err != nil {
+			t.Fatalf("Line %d failed to parse %s: %v", count+1, test.Spec, err)
+		}
+		if m.match([]byte(test.Reply)) != test.Match {
+			t.Fatalf("Line %d %s matching %q should be %v", count+1, test.Spec, test.Reply, test.Match)
+		}
+	}
+}
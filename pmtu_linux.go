@@ -0,0 +1,397 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	PMTUDefaultMax   = 1500
+	PMTUProbeTimeout = time.Second
+	PMTUProbeTries   = 2 // a probe that vanishes is sent again before we believe it was dropped
+)
+
+// What became of a path MTU probe packet
+const (
+	pmtuDelivered = iota // the far end answered, so it got there
+	pmtuTooBig           // a router, or our own interface, says it needs fragmenting
+	pmtuSilent           // it vanished
+)
+
+var errPMTUTimeout = errors.New("search didn't finish within the timeout")
+
+// Sends a DF-set probe of the given size (the whole IP packet, headers included) and reports what became of it.
+// For pmtuTooBig, mtu is the next hop MTU if we were told it.
+type pmtuSender func(size int) (result, mtu int, err error)
+
+// Path MTU test. DF-set packets of increasing size are sent along the test's path, and the largest that gets there
+// is the path MTU. pmtu tests send UDP to the test's port (33434, like traceroute, if none is given) and count
+// either a reply or a port unreachable from the far end as delivered, so this works without root on Linux.
+// pmtu:icmp tests send echo requests instead, and need root.
+// The test fails if the path MTU is below the minmtu option, or if large packets vanish without a Fragmentation
+// Needed or Packet Too Big coming back, which is the MTU black hole that kills connections across tunnels.
+func runPMTUTest(afnet string, test *SubTest, p *ICMPPublisher) {
+	debug.Println("Doing path MTU test")
+
+	test.run = true
+	v6 := afnet == "pmtu6" || (afnet == "pmtu" && isV6(test.raddr))
+	floor := 576 // every IPv4 host must take this
+	if v6 {
+		floor = 1280 // the IPv6 minimum link MTU
+	}
+	max := PMTUDefaultMax
+	if test.opts.pmtuMax > 0 {
+		max = test.opts.pmtuMax
+	}
+	if max < floor {
+		floor = max
+	}
+
+	var send pmtuSender
+	if isICMP(test.net) {
+		probe, err := newICMPPMTUProbe(v6, test, p)
+		if err != nil {
+			test.error = "Path MTU " + err.Error()
+			return
+		}
+		defer probe.Close()
+		send = probe.send
+	} else {
+		probe, err := newUDPPMTUProbe(v6, test)
+		if err != nil {
+			test.error = "Path MTU " + err.Error()
+			return
+		}
+		defer probe.Close()
+		send = probe.send
+	}
+
+	// Nothing we learn means anything unless the smallest packet gets there
+	start := time.Now()
+	result, _, err := send(floor)
+	switch {
+	case err != nil:
+		test.state = StateRejected
+		test.error = "Path MTU " + err.Error()
+		return
+	case result == pmtuSilent:
+		test.state = StateSilent
+		test.error = fmt.Sprintf("No answer to %d byte packets, can't measure the path MTU", floor)
+		return
+	case result == pmtuTooBig:
+		test.state = StateRejected
+		test.error = fmt.Sprintf("Even %d byte packets are too big", floor)
+		return
+	}
+	test.state = StateAnswered
+	test.rtt = time.Since(start)
+
+	pmtu, blackhole, err := discoverPMTU(send, floor, max)
+	test.info = fmt.Sprintf("Path MTU %d", pmtu)
+	switch {
+	case err != nil:
+		test.error = fmt.Sprintf("Path MTU %s after %d byte packets got through", err, pmtu)
+	case blackhole > 0:
+		test.error = fmt.Sprintf("%d byte packets vanish without a Fragmentation Needed or Packet Too Big, path MTU %d (MTU black hole)", blackhole, pmtu)
+	case pmtu < test.opts.pmtuMin:
+		test.error = fmt.Sprintf("Path MTU %d is below minmtu %d", pmtu, test.opts.pmtuMin)
+	default:
+		test.passed = true
+	}
+	debug.Println(fmtSubTest(*test))
+}
+
+// Each probe is waited for for PMTUProbeTimeout, but the whole search has to fit in the test's timeout, which ends at
+// deadline
+func pmtuProbeDeadline(deadline time.Time) (time.Time, error) {
+	now := time.Now()
+	if !now.Before(deadline) {
+		return now, errPMTUTimeout
+	}
+	if until := now.Add(PMTUProbeTimeout); until.Before(deadline) {
+		return until, nil
+	}
+	return deadline, nil
+}
+
+// Binary search for the largest packet that gets through, between floor (which has) and max. A next hop MTU from a
+// Fragmentation Needed or Packet Too Big lets us jump straight to it. Sizes that vanish without one are the black
+// hole we're really looking for, and the smallest of those is returned too (or 0).
+func discoverPMTU(send pmtuSender, floor, max int) (pmtu, blackhole int, err error) {
+	low, high, size := floor, max, max
+	for low < high {
+		result, mtu, err := send(size)
+		if err != nil {
+			return low, blackhole, err
+		}
+		debug.Printf("Path MTU probe of %d bytes: result %d mtu %d", size, result, mtu)
+		switch result {
+		case pmtuDelivered:
+			low = size
+		case pmtuTooBig:
+			high = size - 1
+			if mtu > low && mtu < size {
+				high, size = mtu, mtu
+				continue
+			}
+		case pmtuSilent:
+			if blackhole == 0 || size < blackhole {
+				blackhole = size
+			}
+			high = size - 1
+		}
+		size = (low + high + 1) / 2
+	}
+	return low, blackhole, nil
+}
+
+// Ask the kernel to set DF, and to ignore what it thinks the path MTU is so we can find out for ourselves.
+// Anything bigger than the interface MTU still fails the send with EMSGSIZE.
+func setDontFragment(c syscall.RawConn, v6 bool) error {
+	level, opt, val := syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE
+	if v6 {
+		level, opt, val = syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE
+	}
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), level, opt, val)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// Size of the IP and upper layer headers, which count towards the MTU
+func pmtuHeaderLen(v6 bool) int {
+	if v6 {
+		return 40 + 8
+	}
+	return 20 + 8
+}
+
+type udpPMTUProbe struct {
+	*net.UDPConn
+	hdr      int
+	raddr    string
+	deadline time.Time
+}
+
+func newUDPPMTUProbe(v6 bool, test *SubTest) (*udpPMTUProbe, error) {
+	network := "udp4"
+	if v6 {
+		network = "udp6"
+	}
+	test.raddr = withDefaultPort(test.raddr, "33434")
+	laddr, err := net.ResolveUDPAddr(network, test.laddr)
+	if err != nil {
+		return nil, err
+	}
+	d := net.Dialer{
+		Timeout:   testTimeout(test.opts),
+		LocalAddr: laddr,
+		Control: func(network, address string, c syscall.RawConn) error {
+			return setDontFragment(c, v6)
+		},
+	}
+	conn, err := d.Dial(network, test.raddr)
+	if err != nil {
+		return nil, err
+	}
+	test.laddr_used = conn.LocalAddr().String()
+	test.raddr_used = conn.RemoteAddr().String()
+	udpConn := conn.(*net.UDPConn)
+	if err = enableRecvErr(udpConn); err != nil {
+		debug.Println("Failed to enable IP_RECVERR:", err)
+	}
+	return &udpPMTUProbe{UDPConn: udpConn, hdr: pmtuHeaderLen(v6), raddr: ipOnly(test.raddr_used), deadline: time.Now().Add(testTimeout(test.opts))}, nil
+}
+
+func (u *udpPMTUProbe) send(size int) (int, int, error) {
+	u.drain()
+	buf := make([]byte, 1500)
+	for try := 0; try < PMTUProbeTries; try++ {
+		until, err := pmtuProbeDeadline(u.deadline)
+		if err != nil {
+			if try > 0 {
+				break // it vanished for as long as we had to wait
+			}
+			return 0, 0, err
+		}
+		if _, err = u.Write(make([]byte, size-u.hdr)); err != nil {
+			// either it's too big for our own interface, or an ICMP error for an earlier probe is waiting for us
+			return u.icmpResult(err)
+		}
+		u.SetReadDeadline(until)
+		_, err = u.Read(buf)
+		if err == nil {
+			return pmtuDelivered, 0, nil
+		}
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			continue
+		}
+		return u.icmpResult(err)
+	}
+	return pmtuSilent, 0, nil
+}
+
+// Throw away whatever came back for earlier probes, most likely a late reply to one we gave up on, so that it isn't
+// taken as the answer to the next (bigger) one. The replies can be anything, so there's nothing in them to match on.
+func (u *udpPMTUProbe) drain() {
+	rc, err := u.SyscallConn()
+	if err != nil {
+		return
+	}
+	buf := make([]byte, 1500)
+	rc.Control(func(fd uintptr) {
+		for i := 0; i < 100; i++ {
+			if _, _, err := syscall.Recvfrom(int(fd), buf, syscall.MSG_DONTWAIT); err == syscall.EAGAIN {
+				break
+			}
+		}
+	})
+	for i := 0; i < 100; i++ {
+		if _, err := readErrQueue(u.UDPConn); errors.Is(err, syscall.EAGAIN) {
+			break
+		}
+	}
+}
+
+func (u *udpPMTUProbe) icmpResult(err error) (int, int, error) {
+	msg, qerr := readErrQueue(u.UDPConn)
+	switch {
+	case qerr != nil && errors.Is(err, syscall.EMSGSIZE):
+		return pmtuTooBig, 0, nil
+	case qerr != nil && isConnRefused(err):
+		return pmtuDelivered, 0, nil // port unreachable, and only the far end sends those
+	case qerr != nil:
+		return 0, 0, err
+	case msg.mtu > 0:
+		return pmtuTooBig, msg.mtu, nil
+	case msg.unreachable() && msg.from == u.raddr:
+		return pmtuDelivered, 0, nil // the far end itself said no, so it got there
+	}
+	return 0, 0, fmt.Errorf("%s (from %s)", msg.desc, msg.from)
+}
+
+type icmpPMTUProbe struct {
+	net.Conn
+	p           *ICMPPublisher
+	icmpCh      chan ICMPMessage
+	v6          bool
+	hdr         int
+	raddr       string
+	id, seq     int
+	echoRequest int
+	echoReply   int
+	deadline    time.Time
+}
+
+func newICMPPMTUProbe(v6 bool, test *SubTest, p *ICMPPublisher) (*icmpPMTUProbe, error) {
+	if !gotRoot {
+		return nil, errors.New("ICMP tests require root access")
+	}
+	probe := &icmpPMTUProbe{p: p, v6: v6, hdr: pmtuHeaderLen(v6), echoRequest: ICMP4_ECHO_REQUEST, echoReply: ICMP4_ECHO_REPLY}
+	probe.deadline = time.Now().Add(testTimeout(test.opts))
+	dialNet := "ip4:icmp"
+	if v6 {
+		dialNet, probe.echoRequest, probe.echoReply = "ip6:ipv6-icmp", ICMP6_ECHO_REQUEST, ICMP6_ECHO_REPLY
+	}
+
+	d := net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return setDontFragment(c, v6)
+		},
+	}
+	if len(test.laddr) > 0 {
+		lhost, _, err := net.SplitHostPort(test.laddr)
+		if err != nil {
+			lhost = test.laddr
+		}
+		if d.LocalAddr, err = net.ResolveIPAddr(dialNet[:3], strings.Trim(lhost, "[]")); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := d.Dial(dialNet, strings.Trim(test.raddr, "[]"))
+	if err != nil {
+		return nil, err
+	}
+	test.laddr_used = conn.LocalAddr().String()
+	test.raddr_used = conn.RemoteAddr().String()
+	probe.Conn = conn
+	probe.raddr = ipOnly(test.raddr_used)
+	probe.id = nextPingID()
+	probe.icmpCh = p.Subscribe()
+	return probe, nil
+}
+
+func (c *icmpPMTUProbe) Close() error {
+	c.p.Unsubscribe(c.icmpCh)
+	return c.Conn.Close()
+}
+
+func (c *icmpPMTUProbe) send(size int) (int, int, error) {
+	for try := 0; try < PMTUProbeTries; try++ {
+		until, err := pmtuProbeDeadline(c.deadline)
+		if err != nil {
+			if try > 0 {
+				break
+			}
+			return 0, 0, err
+		}
+		c.seq++
+		if _, err := c.Write(makeICMPEcho(c.echoRequest, c.id, c.seq, make([]byte, size-c.hdr))); err != nil {
+			if errors.Is(err, syscall.EMSGSIZE) {
+				return pmtuTooBig, 0, nil
+			}
+			return 0, 0, err
+		}
+		timeout := time.After(time.Until(until))
+	wait:
+		for {
+			select {
+			case msg := <-c.icmpCh:
+				if msg.v6 != c.v6 || msg.id != c.id || msg.seq != c.seq {
+					continue
+				}
+				if int(msg.msgtype) == c.echoReply {
+					if msg.from != c.raddr {
+						continue
+					}
+					return pmtuDelivered, 0, nil
+				}
+				if msg.mtu > 0 {
+					return pmtuTooBig, msg.mtu, nil
+				}
+				return 0, 0, fmt.Errorf("%s (from %s)", msg.desc, msg.from)
+			case <-timeout:
+				break wait
+			}
+		}
+	}
+	return pmtuSilent, 0, nil
+}
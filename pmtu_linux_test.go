@@ -0,0 +1,132 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// A path to probe: packets up to mtu get there. Bigger ones get a Packet Too Big (with the MTU if tell is set), or
+// vanish if blackhole is set.
+type fakePath struct {
+	mtu       int
+	tell      bool
+	blackhole bool
+	broken    int // sizes from this on get an ICMP error, if set
+}
+
+func (f fakePath) send(size int) (int, int, error) {
+	switch {
+	case f.broken > 0 && size >= f.broken:
+		return 0, 0, errors.New("Communication administratively prohibited")
+	case size <= f.mtu:
+		return pmtuDelivered, 0, nil
+	case f.blackhole:
+		return pmtuSilent, 0, nil
+	case f.tell:
+		return pmtuTooBig, f.mtu, nil
+	}
+	return pmtuTooBig, 0, nil
+}
+
+func TestDiscoverPMTU(t *testing.T) {
+	var tests = []struct {
+		Path      fakePath
+		Max       int
+		PMTU      int
+		Blackhole int
+		Err       bool
+	}{
+		{fakePath{mtu: 9000}, 1500, 1500, 0, false},
+		{fakePath{mtu: 1400, tell: true}, 1500, 1400, 0, false},
+		{fakePath{mtu: 1450}, 1500, 1450, 0, false},
+		{fakePath{mtu: 1400, blackhole: true}, 1500, 1400, 1401, false},
+		{fakePath{mtu: 1280, blackhole: true}, 9000, 1280, 1281, false},
+		{fakePath{mtu: 9000, broken: 1000}, 1500, 576, 0, true},
+	}
+	for count, test := range tests {
+		pmtu, blackhole, err := discoverPMTU(test.Path.send, 576, test.Max)
+		if pmtu != test.PMTU || blackhole != test.Blackhole || (err != nil) != test.Err {
+			t.Fatalf("Line %d path MTU should be %d with black hole %d, got %d %d %v", count+1, test.PMTU, test.Blackhole, pmtu, blackhole, err)
+		}
+	}
+}
+
+// A path that never answers has to give up within the test's timeout, not after every probe has had its full wait
+func TestPMTUTimeout(t *testing.T) {
+	silent, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	opts, err := parseTestOptions([]string{"timeout=300ms"})
+	if err != nil {
+		t.Fatal("Options rejected:", err)
+	}
+	test := SubTest{net: "pmtu4", raddr: silent.LocalAddr().String(), opts: opts}
+	start := time.Now()
+	runPMTUTest("pmtu4", &test, nil)
+	if elapsed := time.Since(start); elapsed > PMTUProbeTimeout {
+		t.Fatalf("Path MTU search took %v with a 300ms timeout", elapsed)
+	}
+	if test.passed || test.state != StateSilent {
+		t.Fatalf("Silent path should have failed as silent: %s", fmtSubTest(test))
+	}
+
+	if _, err = pmtuProbeDeadline(time.Now().Add(-time.Second)); err != errPMTUTimeout {
+		t.Fatal("Probe allowed after the deadline:", err)
+	}
+	deadline := time.Now().Add(time.Hour)
+	if until, _ := pmtuProbeDeadline(deadline); !until.Before(deadline) {
+		t.Fatal("Probe wait not limited to PMTUProbeTimeout:", until)
+	}
+}
+
+// A late reply to an earlier probe mustn't count as the next one getting there
+func TestPMTUStaleReply(t *testing.T) {
+	srv, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	opts, err := parseTestOptions([]string{"timeout=300ms"})
+	if err != nil {
+		t.Fatal("Options rejected:", err)
+	}
+	probe, err := newUDPPMTUProbe(false, &SubTest{net: "pmtu4", raddr: srv.LocalAddr().String(), opts: opts})
+	if err != nil {
+		t.Fatal("Failed to set up the probe:", err)
+	}
+	defer probe.Close()
+
+	if _, err = srv.WriteTo([]byte("late"), probe.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if result, _, err := probe.send(1400); result != pmtuSilent || err != nil {
+		t.Fatalf("Stale reply taken as an answer: result %d %v", result, err)
+	}
+}
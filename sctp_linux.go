@@ -0,0 +1,225 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// from linux/sctp.h
+const (
+	SOL_SCTP               = 132
+	SCTP_SOCKOPT_BINDX_ADD = 100
+	SCTP_SOCKOPT_CONNECTX  = 110
+	sizeofSockaddrInet4    = 16
+	sizeofSockaddrInet6    = 28
+)
+
+// SCTP association test. The kernel does the INIT/INIT-ACK/COOKIE-ECHO/COOKIE-ACK handshake for us on connect;
+// an ABORT comes back as ECONNREFUSED, same as a TCP RST. afnet is sctp, sctp4 or sctp6.
+// Extra local and remote addresses for multi-homed associations come from the laddrs and raddrs options.
+func runSCTPTest(afnet string, test *SubTest, p *ICMPPublisher) {
+	debug.Println("Doing SCTP test")
+
+	test.run = true
+	tcpnet := "tcp" + strings.TrimPrefix(afnet, "sctp") // same address syntax, so let the TCP resolver do the work
+	raddrs, err := resolveSCTPAddrs(tcpnet, test.raddr, test.opts.sctpRAddrs)
+	if err != nil {
+		test.error = "SCTP Resolve error: " + err.Error()
+		return
+	}
+	if len(raddrs) == 0 { // everything below, down to the connect, needs at least one
+		test.error = "SCTP Resolve error: no remote address"
+		return
+	}
+	laddrs, err := resolveSCTPAddrs(tcpnet, test.laddr, test.opts.sctpLAddrs)
+	if err != nil {
+		test.error = "SCTP Resolve error: " + err.Error()
+		return
+	}
+
+	family := syscall.AF_INET
+	if raddrs[0].IP.To4() == nil {
+		family = syscall.AF_INET6
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, syscall.IPPROTO_SCTP)
+	if err != nil {
+		test.error = "SCTP Socket error: " + err.Error()
+		if err == syscall.EPROTONOSUPPORT {
+			test.error += " (is the sctp kernel module loaded?)"
+		}
+		return
+	}
+	f := os.NewFile(uintptr(fd), "sctp") // hands the fd to the runtime poller, so we get timeouts for free
+	defer f.Close()
+
+	if len(laddrs) > 0 {
+		if err = syscall.Bind(fd, sockaddr(laddrs[0])); err == nil && len(laddrs) > 1 {
+			err = syscall.SetsockoptString(fd, SOL_SCTP, SCTP_SOCKOPT_BINDX_ADD, packSockaddrs(laddrs[1:]))
+		}
+		if err != nil {
+			test.error = "SCTP Bind error: " + err.Error()
+			return
+		}
+	}
+
+	f.SetDeadline(time.Now().Add(testTimeout(test.opts)))
+	rc, err := f.SyscallConn()
+	if err != nil {
+		test.error = "SCTP error: " + err.Error()
+		return
+	}
+
+	start := time.Now()
+	started := false
+	var cerr error
+	err = rc.Write(func(fd uintptr) bool {
+		if !started {
+			started = true
+			if len(raddrs) > 1 {
+				cerr = syscall.SetsockoptString(int(fd), SOL_SCTP, SCTP_SOCKOPT_CONNECTX, packSockaddrs(raddrs))
+			} else {
+				cerr = syscall.Connect(int(fd), sockaddr(raddrs[0]))
+			}
+			return cerr != syscall.EINPROGRESS // otherwise wait until it's writable, i.e. the association is up or failed
+		}
+		var soerr int
+		soerr, cerr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_ERROR)
+		if cerr == nil && soerr != 0 {
+			cerr = syscall.Errno(soerr)
+		}
+		return true
+	})
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		test.state, test.refused = sctpConnectState(err)
+		if !test.refused {
+			test.error = "SCTP Connect error: " + err.Error()
+		}
+		debug.Println(fmtSubTest(*test))
+		return
+	}
+	test.rtt = time.Since(start)
+	test.state = StateAnswered
+
+	if sa, err := syscall.Getsockname(fd); err == nil {
+		test.laddr_used = sockaddrString(sa)
+	}
+	if sa, err := syscall.Getpeername(fd); err == nil {
+		test.raddr_used = sockaddrString(sa)
+	}
+	if len(raddrs) > 1 || len(laddrs) > 1 {
+		test.info = fmt.Sprintf("multi-homed, %d local and %d remote addresses", len(laddrs), len(raddrs))
+	}
+	test.passed = true
+	debug.Println("*****Completed: ", fmtSubTest(*test))
+}
+
+// An ABORT (ECONNREFUSED) or an ICMP unreachable (EHOSTUNREACH, ENETUNREACH, or EACCES for administratively
+// prohibited) turns the association away, and counts as refused just as a RST does for TCP
+func sctpConnectState(err error) (string, bool) {
+	for _, errno := range []syscall.Errno{syscall.ECONNREFUSED, syscall.EHOSTUNREACH, syscall.ENETUNREACH, syscall.EACCES} {
+		if errors.Is(err, errno) {
+			return StateRejected, true
+		}
+	}
+	return connectErrorState(err), false
+}
+
+// The primary address from the test, plus any extras from the options. The extras are bare IPs and share the
+// primary's port. An empty primary (any local address) means no addresses at all.
+func resolveSCTPAddrs(tcpnet, primary string, extras []string) ([]*net.TCPAddr, error) {
+	if primary == "" {
+		if len(extras) > 0 {
+			return nil, errors.New("extra addresses need a primary address on the test as well")
+		}
+		return nil, nil
+	}
+	addr, err := net.ResolveTCPAddr(tcpnet, primary)
+	if err != nil {
+		return nil, err
+	}
+	addrs := []*net.TCPAddr{addr}
+	for _, extra := range extras {
+		a, err := net.ResolveTCPAddr(tcpnet, net.JoinHostPort(strings.Trim(extra, "[]"), strconv.Itoa(addr.Port)))
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, a)
+	}
+	return addrs, nil
+}
+
+func sockaddr(addr *net.TCPAddr) syscall.Sockaddr {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		sa := &syscall.SockaddrInet4{Port: addr.Port}
+		copy(sa.Addr[:], ip4)
+		return sa
+	}
+	sa := &syscall.SockaddrInet6{Port: addr.Port}
+	copy(sa.Addr[:], addr.IP.To16())
+	if addr.Zone != "" {
+		if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+			sa.ZoneId = uint32(ifi.Index)
+		}
+	}
+	return sa
+}
+
+func sockaddrString(sa syscall.Sockaddr) string {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(sa.Port))
+	case *syscall.SockaddrInet6:
+		return net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(sa.Port))
+	}
+	return ""
+}
+
+// sctp_bindx and sctp_connectx take a packed array of sockaddr_in/sockaddr_in6
+func packSockaddrs(addrs []*net.TCPAddr) string {
+	var b []byte
+	for _, addr := range addrs {
+		var sa []byte
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			sa = make([]byte, sizeofSockaddrInet4)
+			*(*uint16)(unsafe.Pointer(&sa[0])) = syscall.AF_INET
+			copy(sa[4:8], ip4)
+		} else {
+			sa = make([]byte, sizeofSockaddrInet6)
+			*(*uint16)(unsafe.Pointer(&sa[0])) = syscall.AF_INET6
+			copy(sa[8:24], addr.IP.To16())
+		}
+		sa[2], sa[3] = byte(addr.Port>>8), byte(addr.Port) // network byte order
+		b = append(b, sa...)
+	}
+	return string(b)
+}
@@ -0,0 +1,80 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestResolveSCTPAddrs(t *testing.T) {
+	addrs, err := resolveSCTPAddrs("tcp", "10.0.0.1:2905", []string{"10.0.1.1", "[2001:db8::1]"})
+	if err != nil {
+		t.Fatal("Failed to resolve:", err)
+	}
+	if len(addrs) != 3 || addrs[1].Port != 2905 || !addrs[2].IP.Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("Addresses resolved incorrectly: %v", addrs)
+	}
+	packed := packSockaddrs(addrs)
+	if len(packed) != 2*sizeofSockaddrInet4+sizeofSockaddrInet6 || packed[2:4] != "\x0b\x59" || packed[4:8] != "\x0a\x00\x00\x01" {
+		t.Fatalf("Addresses packed incorrectly: %q", packed)
+	}
+
+	if addrs, err = resolveSCTPAddrs("tcp", "", nil); err != nil || addrs != nil {
+		t.Fatalf("Any local address resolved incorrectly: %v %v", addrs, err)
+	}
+	if _, err = resolveSCTPAddrs("tcp", "", []string{"10.0.1.1"}); err == nil {
+		t.Fatal("Extra addresses accepted without a primary")
+	}
+}
+
+func TestSCTPNoRemoteAddress(t *testing.T) {
+	test := &SubTest{opts: &TestOptions{}}
+	runSCTPTest("sctp", test, nil)
+	if !test.run || test.passed || test.error != "SCTP Resolve error: no remote address" {
+		t.Fatalf("Empty remote address handled incorrectly: %+v", *test)
+	}
+}
+
+func TestSCTPConnectState(t *testing.T) {
+	var tests = []struct {
+		Err     error
+		State   string
+		Refused bool
+	}{
+		{syscall.ECONNREFUSED, StateRejected, true},
+		{syscall.EHOSTUNREACH, StateRejected, true},
+		{syscall.ENETUNREACH, StateRejected, true},
+		{syscall.EACCES, StateRejected, true},
+		{syscall.ECONNRESET, StateRejected, false},
+		{syscall.ETIMEDOUT, StateSilent, false}, // INIT retransmissions ran out
+		{syscall.EINVAL, "", false},
+		{os.ErrDeadlineExceeded, StateSilent, false},
+	}
+	for count, test := range tests {
+		state, refused := sctpConnectState(test.Err)
+		if state != test.State || refused != test.Refused {
+			t.Fatalf("Line %d %v should be %q refused=%v, got %q %v", count+1, test.Err, test.State, test.Refused, state, refused)
+		}
+	}
+}
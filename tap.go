@@ -0,0 +1,65 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TAP for --format=tap, for shell test harnesses: a test point per test for this host, with what each of a failed
+// test's subtests found as diagnostics
+func tapReport(tests []Test) string {
+	var points []string
+	for _, test := range tests {
+		if !test.attempt {
+			continue
+		}
+		n := len(points) + 1
+		desc := tapEscape(strings.TrimSpace(test.ref + " " + test.desc))
+		if test.passed {
+			points = append(points, fmt.Sprintf("ok %d - %s", n, desc))
+			continue
+		}
+		point := fmt.Sprintf("not ok %d - %s", n, desc)
+		if !test.run {
+			point += " # SKIP not run"
+		}
+		if test.error != "" {
+			point += "\n# " + testResult(test) + ": " + test.error
+		}
+		for subTestV := test.subTests.Front(); subTestV != nil; subTestV = subTestV.Next() {
+			subTest := subTestV.Value.(*SubTest)
+			point += "\n#   " + strings.TrimSpace(subTest.subref+" "+subTestSummary(*subTest))
+		}
+		points = append(points, point)
+	}
+	out := fmt.Sprintf("TAP version 13\n1..%d\n", len(points))
+	for _, point := range points {
+		out += point + "\n"
+	}
+	return out
+}
+
+// # starts a directive in a test point's description
+func tapEscape(s string) string {
+	return strings.ReplaceAll(s, "#", "\\#")
+}
@@ -0,0 +1,49 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestTAPReport(t *testing.T) {
+	tests := []Test{
+		{ref: "1", desc: "web", attempt: true, run: true, passed: true},
+		{ref: "2", desc: "db #1", attempt: true, run: true, error: "2.2 refused;"},
+		{ref: "3", desc: "someone else's"},
+		{ref: "4", attempt: true},
+	}
+	tests[1].subTests.PushBack(&SubTest{subref: "2.1", raddr: "10.0.0.2:5432", run: true, passed: true})
+	tests[1].subTests.PushBack(&SubTest{subref: "2.2", raddr: "10.0.0.3:5432", run: true, refused: true, state: StateRejected})
+	tests[3].subTests.PushBack(&SubTest{raddr: "10.0.0.4:53"})
+
+	want := "TAP version 13\n1..3\n" +
+		"ok 1 - 1 web\n" +
+		"not ok 2 - 2 db \\#1\n" +
+		"# FAILED: 2.2 refused;\n" +
+		"#   2.1 10.0.0.2:5432 PASSED\n" +
+		"#   2.2 10.0.0.3:5432 FAILED (rejected)\n" +
+		"not ok 3 - 4 # SKIP not run\n" +
+		"#   10.0.0.4:53 PENDING\n"
+	if got := tapReport(tests); got != want {
+		t.Fatalf("TAP output is wrong, got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,155 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+var TLSVersions map[string]uint16 = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLS probe. Completes a handshake and checks the far end's certificate, so TLS intercepting middleboxes and
+// certificates about to expire show up. afnet is tls, tls4 or tls6
+func runTLSTest(afnet string, test *SubTest, p *ICMPPublisher) {
+	debug.Println("Doing TLS test")
+
+	test.raddr = withDefaultPort(test.raddr, "443")
+	test.run = true
+	conn, err := dialSubTest("tcp"+strings.TrimPrefix(afnet, "tls"), test)
+	if err != nil {
+		test.state = connectErrorState(err)
+		test.refused = isConnRefused(err)
+		test.error = "TLS Connect error: " + err.Error()
+		return
+	}
+	defer conn.Close()
+
+	serverName := test.opts.tlsServerName
+	if serverName == "" {
+		host := test.remoteName()
+		if net.ParseIP(host) == nil {
+			serverName = host
+		}
+	}
+	config := &tls.Config{
+		ServerName:         serverName,
+		NextProtos:         test.opts.tlsALPN,
+		MinVersion:         test.opts.tlsMinVersion,
+		InsecureSkipVerify: true, // we verify it ourselves below, so we can report on it rather than just bail out
+	}
+
+	conn.SetDeadline(time.Now().Add(testTimeout(test.opts)))
+	start := time.Now()
+	tconn := tls.Client(conn, config)
+	if err = tconn.Handshake(); err != nil {
+		test.state = connectErrorState(err)
+		test.error = "TLS Handshake error: " + err.Error()
+		return
+	}
+	test.rtt = time.Since(start)
+	test.state = StateAnswered
+
+	// SNI can't be an address, but the certificate still has to be for the one we connected to
+	verifyName := serverName
+	if verifyName == "" {
+		verifyName = test.remoteName()
+	}
+	info, err := checkTLSState(tconn.ConnectionState(), verifyName, test.opts, time.Now())
+	test.info = info
+	if err != nil {
+		test.error = err.Error()
+		return
+	}
+	test.passed = true
+	debug.Println("*****Completed: ", fmtSubTest(*test))
+}
+
+// Describe the negotiated session and the peer certificate, and fail it if it doesn't meet the test's requirements.
+// serverName is the host name or IP address the certificate must be for.
+func checkTLSState(state tls.ConnectionState, serverName string, opts *TestOptions, now time.Time) (string, error) {
+	if len(state.PeerCertificates) == 0 {
+		return "", fmt.Errorf("No peer certificate")
+	}
+	cert := state.PeerCertificates[0]
+	info := fmt.Sprintf("%s %s", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	if state.NegotiatedProtocol != "" {
+		info += " ALPN " + state.NegotiatedProtocol
+	}
+	info += fmt.Sprintf(", subject %s, issuer %s, expires %s", cert.Subject, cert.Issuer, cert.NotAfter.UTC().Format(time.RFC3339))
+
+	intermediates := x509.NewCertPool()
+	for _, c := range state.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	_, verr := cert.Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         opts.tlsRoots, // nil means the system roots
+		Intermediates: intermediates,
+		CurrentTime:   now,
+	})
+	if verr == nil {
+		info += ", trusted"
+	} else {
+		info += ", untrusted"
+	}
+
+	switch {
+	case verr != nil && !opts.tlsNoVerify:
+		return info, fmt.Errorf("Certificate not trusted: %v", verr)
+	case now.After(cert.NotAfter):
+		return info, fmt.Errorf("Certificate expired %s", cert.NotAfter.UTC().Format(time.RFC3339))
+	case opts.tlsMinValidity > 0 && now.Add(opts.tlsMinValidity).After(cert.NotAfter):
+		return info, fmt.Errorf("Certificate expires in %v, less than the minimum of %v", cert.NotAfter.Sub(now).Round(time.Hour), opts.tlsMinValidity)
+	case len(opts.tlsALPN) > 0 && state.NegotiatedProtocol == "":
+		return info, fmt.Errorf("No ALPN protocol negotiated, wanted one of %s", strings.Join(opts.tlsALPN, ","))
+	}
+	return info, nil
+}
+
+func parseTLSVersion(s string) (uint16, error) {
+	if v, ok := TLSVersions[strings.TrimPrefix(strings.ToLower(s), "tls")]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version, use one of 1.0, 1.1, 1.2 or 1.3")
+}
+
+func loadCAFile(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
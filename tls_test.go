@@ -0,0 +1,96 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTLSProbe(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0) // we hang up without being polite about it
+	srv.StartTLS()
+	defer srv.Close()
+	raddr := strings.TrimPrefix(srv.URL, "https://")
+
+	cafile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(cafile, ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		Options []string
+		Passed  bool
+	}{
+		{[]string{"cafile=" + cafile, "sni=example.com"}, true},
+		{[]string{"cafile=" + cafile, "sni=wrong.example.org"}, false},
+		{[]string{"cafile=" + cafile}, true}, // the certificate is for 127.0.0.1 too
+		{[]string{"verify=no"}, true},
+		{nil, false}, // self signed, so not trusted by the system roots
+		{[]string{"verify=no", "minvalidity=36500d"}, false},
+		{[]string{"verify=no", "tlsmin=1.3"}, true},
+	}
+	for count, test := range tests {
+		opts, err := parseTestOptions(test.Options)
+		if err == nil {
+			err = opts.loadFiles()
+		}
+		if err != nil {
+			t.Fatalf("Line %d options rejected: %v", count+1, err)
+		}
+		subTest := SubTest{net: "tcp", raddr: raddr, opts: opts}
+		runTLSTest("tls", &subTest, nil)
+		if subTest.passed != test.Passed {
+			t.Fatalf("Line %d should have passed=%v: %s", count+1, test.Passed, fmtSubTest(subTest))
+		}
+		if !strings.Contains(subTest.info, "TLS 1.3") {
+			t.Fatalf("Line %d did not report the TLS version: %s", count+1, subTest.info)
+		}
+	}
+}
+
+func TestCheckTLSStateAddress(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	state := tls.ConnectionState{Version: tls.VersionTLS13, PeerCertificates: []*x509.Certificate{srv.Certificate()}}
+	opts := &TestOptions{tlsRoots: roots}
+
+	if _, err := checkTLSState(state, "127.0.0.1", opts, time.Now()); err != nil {
+		t.Fatal("Certificate for 127.0.0.1 not accepted for it:", err)
+	}
+	if _, err := checkTLSState(state, "10.0.0.1", opts, time.Now()); err == nil {
+		t.Fatal("Certificate accepted for an address it isn't for")
+	}
+}
@@ -0,0 +1,174 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	TracerouteMaxHops    = 30
+	TracerouteMaxSilent  = 3 // give up after this many hops in a row say nothing
+	TracerouteHopTimeout = time.Second
+)
+
+// Find where a failed flow dies, by sending the same probe (same addresses, ports and protocol, so the same
+// firewall rules apply) with increasing TTLs and listening for TIME_EXCEEDED from the routers along the way.
+// Returns a summary for the error text. Needs root, since the answers are ICMP.
+func traceroute(afnet string, test *SubTest, p *ICMPPublisher) string {
+	if !gotRoot {
+		return "Traceroute skipped: needs root"
+	}
+	tcp := strings.HasPrefix(afnet, "tcp")
+
+	// Pin the local port, so every probe is the same flow and we can tell which ICMP messages are about it
+	laddr, err := tracerouteLocalAddr(afnet, test.laddr, tcp)
+	if err != nil {
+		return "Traceroute skipped: " + err.Error()
+	}
+	raddr, err := net.ResolveTCPAddr("tcp"+familySuffix(afnet), test.raddr)
+	if err != nil {
+		return "Traceroute skipped: " + err.Error()
+	}
+	v6 := raddr.IP.To4() == nil
+	target := raddr.String()
+	lport := strconv.Itoa(laddr.Port)
+
+	icmpCh := p.Subscribe()
+	defer p.Unsubscribe(icmpCh)
+
+	lastHop, lastFrom, silent := 0, "", 0
+	for ttl := 1; ttl <= TracerouteMaxHops && silent < TracerouteMaxSilent; ttl++ {
+		d := net.Dialer{
+			Timeout:   TracerouteHopTimeout,
+			LocalAddr: laddr,
+			Control: func(network, address string, c syscall.RawConn) error {
+				return setTTL(c, v6, ttl)
+			},
+		}
+		if !tcp {
+			d.LocalAddr = &net.UDPAddr{IP: laddr.IP, Port: laddr.Port, Zone: laddr.Zone}
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			conn, err := d.Dial(afnet, target)
+			if err == nil {
+				if !tcp {
+					if _, err = conn.Write([]byte("conchk traceroute probe")); err == nil {
+						time.Sleep(TracerouteHopTimeout) // the port needs to stay ours while we wait for the ICMP
+						err = fmt.Errorf("no answer")
+					}
+				}
+				conn.Close()
+			}
+			done <- err
+		}()
+
+		hop, result := waitForHop(afnet, target, lport, ttl, icmpCh, done, time.After(TracerouteHopTimeout+100*time.Millisecond))
+		if result != "" {
+			return result
+		}
+		if hop == "" {
+			debug.Printf("Traceroute hop %d: *", ttl)
+			silent++
+			continue
+		}
+		debug.Printf("Traceroute hop %d: %s", ttl, hop)
+		lastHop, lastFrom, silent = ttl, hop, 0
+	}
+	if lastHop == 0 {
+		return "Traceroute: no hops responded"
+	}
+	return fmt.Sprintf("Traceroute: last responding hop %d %s, nothing after that", lastHop, lastFrom)
+}
+
+// Wait for the answer to one hop's probe, whose dial reports on done. Returns the router whose TIME_EXCEEDED came back,
+// or the result of the whole traceroute if the probe got to the end or was turned away.
+func waitForHop(afnet, target, lport string, ttl int, icmpCh chan ICMPMessage, done chan error, timeout <-chan time.Time) (hop, result string) {
+	tcp := strings.HasPrefix(afnet, "tcp")
+wait:
+	for {
+		select {
+		case msg := <-icmpCh:
+			if !strings.EqualFold(msg.originalProto, afnet[:3]) || msg.originalRAddr != target {
+				continue
+			}
+			if _, port, err := net.SplitHostPort(msg.originalLAddr); err != nil || port != lport {
+				continue
+			}
+			if !msg.unreachable() {
+				hop = msg.from
+				break wait
+			}
+			if done != nil {
+				<-done
+			}
+			return "", fmt.Sprintf("Traceroute: hop %d %s reports %s", ttl, msg.from, msg.desc)
+		case err := <-done:
+			if err == nil || isConnRefused(err) {
+				return "", fmt.Sprintf("Traceroute: reached the destination at hop %d", ttl)
+			}
+			if tcp && connectErrorState(err) != StateSilent {
+				return "", fmt.Sprintf("Traceroute: hop %d %v", ttl, err)
+			}
+			done = nil // keep waiting for the ICMP until the hop times out
+		case <-timeout:
+			break wait
+		}
+	}
+	if done != nil {
+		<-done
+	}
+	return hop, ""
+}
+
+// The local address for traceroute probes. If the test leaves the port to the kernel, borrow one from it now.
+func tracerouteLocalAddr(afnet, laddr string, tcp bool) (*net.TCPAddr, error) {
+	if laddr == "" {
+		laddr = ":0"
+	}
+	addr, err := net.ResolveTCPAddr("tcp"+familySuffix(afnet), laddr)
+	if err != nil || addr.Port != 0 {
+		return addr, err
+	}
+	if tcp {
+		l, err := net.ListenTCP(afnet, addr)
+		if err != nil {
+			return nil, err
+		}
+		addr.Port = l.Addr().(*net.TCPAddr).Port
+		l.Close()
+	} else {
+		c, err := net.ListenUDP(afnet, &net.UDPAddr{IP: addr.IP, Zone: addr.Zone})
+		if err != nil {
+			return nil, err
+		}
+		addr.Port = c.LocalAddr().(*net.UDPAddr).Port
+		c.Close()
+	}
+	return addr, nil
+}
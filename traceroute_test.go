@@ -0,0 +1,124 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWantTraceroute(t *testing.T) {
+	on, off := true, false
+	var tests = []struct {
+		Net    string
+		Global bool
+		Option *bool
+		Want   bool
+	}{
+		{"tcp4", false, nil, false},
+		{"tcp4", true, nil, true},
+		{"udp6", true, &off, false},
+		{"udp", false, &on, true},
+		{"dns", true, &on, false},
+		{"ip4:icmp", true, nil, false},
+	}
+	defer func(saved *bool) { params.Traceroute = saved }(params.Traceroute)
+	for count, test := range tests {
+		global := test.Global
+		params.Traceroute = &global
+		if got := wantTraceroute(test.Net, &TestOptions{traceroute: test.Option}); got != test.Want {
+			t.Fatalf("Line %d traceroute for %s should be %v, got %v", count+1, test.Net, test.Want, got)
+		}
+	}
+}
+
+func TestTracerouteLocalAddr(t *testing.T) {
+	var tests = []struct {
+		Net   string
+		LAddr string
+		Port  int // 0 means any port the kernel picks
+	}{
+		{"tcp4", "127.0.0.1:1025", 1025},
+		{"tcp4", "", 0},
+		{"udp4", "127.0.0.1:", 0},
+	}
+	for count, test := range tests {
+		addr, err := tracerouteLocalAddr(test.Net, test.LAddr, test.Net[:3] == "tcp")
+		if err != nil {
+			t.Fatalf("Line %d failed to pick a local address for %q: %v", count+1, test.LAddr, err)
+		}
+		if addr.Port == 0 || (test.Port != 0 && addr.Port != test.Port) {
+			t.Fatalf("Line %d local address for %q should have a fixed port, got %v", count+1, test.LAddr, addr)
+		}
+	}
+}
+
+func TestWaitForHop(t *testing.T) {
+	target, lport := "192.0.2.1:443", "40000"
+	timedOut := &net.OpError{Op: "dial", Net: "tcp4", Err: os.ErrDeadlineExceeded}
+	exceeded := ICMPMessage{msgtype: ICMP4_TIME_EXCEEDED, from: "198.51.100.1", originalProto: "TCP", originalRAddr: target, originalLAddr: "203.0.113.5:" + lport}
+	unreachable := exceeded
+	unreachable.msgtype, unreachable.code, unreachable.desc = ICMP4_DEST_UNREACHABLE, 13, "Communication administratively prohibited"
+	otherFlow := exceeded
+	otherFlow.originalLAddr = "203.0.113.5:40001"
+
+	var tests = []struct {
+		DialErr error
+		Msgs    []ICMPMessage
+		Hop     string
+		Result  string
+	}{
+		{nil, nil, "", "Traceroute: reached the destination at hop 3"},
+		{timedOut, nil, "", ""},
+		{timedOut, []ICMPMessage{otherFlow, exceeded}, "198.51.100.1", ""},
+		// the dial timing out first mustn't leave us waiting on it again once the unreachable turns up
+		{timedOut, []ICMPMessage{unreachable}, "", "Traceroute: hop 3 198.51.100.1 reports Communication administratively prohibited"},
+	}
+	for count, test := range tests {
+		icmpCh, done := make(chan ICMPMessage), make(chan error, 1)
+		timeout := make(chan time.Time)
+		done <- test.DialErr
+		go func() {
+			time.Sleep(10 * time.Millisecond) // let the dial result be seen first
+			for _, msg := range test.Msgs {
+				icmpCh <- msg
+			}
+			close(timeout)
+		}()
+
+		finished := make(chan bool)
+		var hop, result string
+		go func() {
+			hop, result = waitForHop("tcp4", target, lport, 3, icmpCh, done, timeout)
+			close(finished)
+		}()
+		select {
+		case <-finished:
+		case <-time.After(time.Second):
+			t.Fatalf("Line %d never finished waiting for the hop", count+1)
+		}
+		if hop != test.Hop || result != test.Result {
+			t.Fatalf("Line %d should have got hop %q result %q, got %q %q", count+1, test.Hop, test.Result, hop, result)
+		}
+	}
+}
@@ -0,0 +1,621 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tests are maintained in a spreadsheet anyway, so rather than exporting to CSV every time (and forgetting to),
+// conchk reads .xlsx and .ods workbooks directly. The columns are the same as the CSV, rows starting with # are
+// comments, and --outputbook writes a copy of the workbook with the Result and Summary columns filled in.
+// The header row is skipped, as is anything too short to be a test, like a title.
+type Workbook struct {
+	path  string
+	ods   bool
+	part  string // zip entry holding the sheet for xlsx, or every table for ods
+	sheet string // name of the sheet the tests came from
+	rows  []int  // sheet row (1 based) of each test, in the order they were read
+}
+
+// The workbook the tests came from, if they did, for --outputbook
+var TestsWorkbook *Workbook
+
+// Columns the results go in, as for --outputcsv
+const (
+	ResultColumn  = 9
+	SummaryColumn = 10
+)
+
+type sheetRow struct {
+	num   int
+	cells []string
+}
+
+// Read the tests from a worksheet, the first one if sheet is empty
+func readWorkbookTests(file *os.File, sheet string) ([][]string, *Workbook, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	z, err := zip.NewReader(file, info.Size())
+	if err != nil {
+		return nil, nil, err
+	}
+	book := &Workbook{path: file.Name(), ods: strings.EqualFold(filepath.Ext(file.Name()), ".ods")}
+	var rows []sheetRow
+	if book.ods {
+		rows, err = book.readODS(z, sheet)
+	} else {
+		rows, err = book.readXLSX(z, sheet)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var records [][]string
+	for _, row := range rows {
+		cells := row.cells
+		for len(cells) > 0 && strings.TrimSpace(cells[len(cells)-1]) == "" {
+			cells = cells[:len(cells)-1]
+		}
+		if len(cells) < 9 || strings.HasPrefix(strings.TrimSpace(cells[0]), "#") || isHeaderRow(cells) {
+			continue
+		}
+		records = append(records, cells)
+		book.rows = append(book.rows, row.num)
+	}
+	return records, book, nil
+}
+
+// The column headings, e.g. the bundled sheet's Reference, Description, ..., Protocol
+func isHeaderRow(cells []string) bool {
+	return strings.EqualFold(strings.TrimSpace(cells[8]), "Protocol")
+}
+
+// Write a copy of the workbook with each test's result in it. tests must be in the order they were read.
+func (book *Workbook) writeResults(name string, tests []Test) error {
+	results := make(map[int][]string)
+	for i, test := range tests {
+		if i < len(book.rows) {
+			results[book.rows[i]] = fmtTestCSV(test)[ResultColumn : SummaryColumn+1]
+		}
+	}
+
+	z, err := zip.OpenReader(book.path)
+	if err != nil {
+		return err
+	}
+	defer z.Close()
+	fd, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	w := zip.NewWriter(fd)
+	for _, f := range z.File {
+		if f.Name != book.part {
+			// as is, compressed data and all. This also keeps the ods mimetype entry first and stored, as it must be
+			if err = w.Copy(f); err != nil {
+				return err
+			}
+			continue
+		}
+		data, err := readZipFile(f)
+		if err != nil {
+			return err
+		}
+		if book.ods {
+			data, err = fillODS(data, book.sheet, results)
+		} else {
+			data = fillXLSX(data, results)
+		}
+		if err != nil {
+			return err
+		}
+		out, err := w.CreateHeader(&zip.FileHeader{Name: f.Name, Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			return err
+		}
+		if _, err = out.Write(data); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// Unmarshal an XML entry of the workbook. A missing entry is only an error if it's required.
+func unmarshalZipEntry(z *zip.Reader, name string, required bool, v interface{}) error {
+	for _, f := range z.File {
+		if f.Name == name {
+			data, err := readZipFile(f)
+			if err != nil {
+				return err
+			}
+			return xml.Unmarshal(data, v)
+		}
+	}
+	if required {
+		return fmt.Errorf("no %s in the workbook", name)
+	}
+	return nil
+}
+
+// Text that may be split into runs with different formatting, as in shared and inline strings
+type xlsxText struct {
+	T    string `xml:"t"`
+	Runs []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxText) String() string {
+	s := t.T
+	for _, r := range t.Runs {
+		s += r.T
+	}
+	return s
+}
+
+func (book *Workbook) readXLSX(z *zip.Reader, sheet string) ([]sheetRow, error) {
+	var wb struct {
+		Sheets []struct {
+			Name string `xml:"name,attr"`
+			ID   string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	if err := unmarshalZipEntry(z, "xl/workbook.xml", true, &wb); err != nil {
+		return nil, err
+	}
+	var rels struct {
+		Rels []struct {
+			ID     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	if err := unmarshalZipEntry(z, "xl/_rels/workbook.xml.rels", true, &rels); err != nil {
+		return nil, err
+	}
+	var sst struct {
+		Items []xlsxText `xml:"si"`
+	}
+	if err := unmarshalZipEntry(z, "xl/sharedStrings.xml", false, &sst); err != nil {
+		return nil, err
+	}
+
+	id := ""
+	for _, s := range wb.Sheets {
+		if sheet == "" || s.Name == sheet {
+			id, book.sheet = s.ID, s.Name
+			break
+		}
+	}
+	for _, rel := range rels.Rels {
+		if id != "" && rel.ID == id {
+			if strings.HasPrefix(rel.Target, "/") {
+				book.part = rel.Target[1:]
+			} else {
+				book.part = path.Join("xl", rel.Target)
+			}
+		}
+	}
+	if book.part == "" {
+		return nil, fmt.Errorf("no worksheet %q in the workbook", sheet)
+	}
+
+	var ws struct {
+		Rows []struct {
+			R     int `xml:"r,attr"`
+			Cells []struct {
+				R  string   `xml:"r,attr"`
+				T  string   `xml:"t,attr"`
+				V  string   `xml:"v"`
+				IS xlsxText `xml:"is"`
+			} `xml:"c"`
+		} `xml:"sheetData>row"`
+	}
+	if err := unmarshalZipEntry(z, book.part, true, &ws); err != nil {
+		return nil, err
+	}
+
+	rows := make([]sheetRow, 0, len(ws.Rows))
+	num := 0
+	for _, r := range ws.Rows {
+		num++
+		if r.R > 0 {
+			num = r.R
+		}
+		row := sheetRow{num: num}
+		for _, c := range r.Cells {
+			col := xlsxColumn(c.R)
+			if col < 0 {
+				col = len(row.cells)
+			}
+			for len(row.cells) <= col {
+				row.cells = append(row.cells, "")
+			}
+			switch c.T {
+			case "s":
+				i, err := strconv.Atoi(c.V)
+				if err != nil || i < 0 || i >= len(sst.Items) {
+					return nil, fmt.Errorf("cell %s refers to a missing shared string", c.R)
+				}
+				row.cells[col] = sst.Items[i].String()
+			case "inlineStr":
+				row.cells[col] = c.IS.String()
+			default:
+				row.cells[col] = c.V
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// Column number (0 based) of a cell reference like J12, -1 if there isn't one
+func xlsxColumn(ref string) int {
+	col := 0
+	i := 0
+	for ; i < len(ref) && ref[i] >= 'A' && ref[i] <= 'Z'; i++ {
+		col = col*26 + int(ref[i]-'A') + 1
+	}
+	if i == 0 {
+		return -1
+	}
+	return col - 1
+}
+
+// Column letters for a column number (0 based)
+func xlsxColumnName(col int) string {
+	name := ""
+	for col++; col > 0; col = (col - 1) / 26 {
+		name = string(rune('A'+(col-1)%26)) + name
+	}
+	return name
+}
+
+// The sheet XML is edited in place rather than unmarshalled and marshalled again, which encoding/xml can't do
+// faithfully for these namespaces. Rows and cells don't nest, so finding them is simple enough.
+var (
+	xlsxRowRe   = regexp.MustCompile(`(?s)<(\w+:)?row(\s[^>]*?)?(/>|>(.*?)</(?:\w+:)?row>)`)
+	xlsxCellRe  = regexp.MustCompile(`(?s)<(?:\w+:)?c(?:\s[^>]*?)?(?:/>|>.*?</(?:\w+:)?c>)`)
+	xlsxRefRe   = regexp.MustCompile(`\sr="([A-Z]*)(\d*)"`)
+	xlsxSpansRe = regexp.MustCompile(`\sspans="[^"]*"`)
+)
+
+func fillXLSX(data []byte, results map[int][]string) []byte {
+	var out bytes.Buffer
+	num, last := 0, 0
+	for _, m := range xlsxRowRe.FindAllSubmatchIndex(data, -1) {
+		num++
+		attrs := ""
+		if m[4] >= 0 {
+			attrs = string(data[m[4]:m[5]])
+		}
+		if ref := xlsxRefRe.FindStringSubmatch(attrs); ref != nil {
+			num, _ = strconv.Atoi(ref[2])
+		}
+		values, ok := results[num]
+		if !ok || m[8] < 0 {
+			continue
+		}
+		prefix := ""
+		if m[2] >= 0 {
+			prefix = string(data[m[2]:m[3]])
+		}
+
+		var cells []string
+		col := 0
+		added := false
+		addResults := func() {
+			for i, value := range values {
+				if value != "" {
+					cells = append(cells, xlsxCell(prefix, ResultColumn+i, num, value))
+				}
+			}
+			added = true
+		}
+		for _, cell := range xlsxCellRe.FindAllString(string(data[m[8]:m[9]]), -1) {
+			if ref := xlsxRefRe.FindStringSubmatch(cell[:strings.Index(cell, ">")]); ref != nil && ref[1] != "" {
+				col = xlsxColumn(ref[1])
+			}
+			if col >= ResultColumn && !added {
+				addResults()
+			}
+			if col != ResultColumn && col != SummaryColumn {
+				cells = append(cells, cell)
+			}
+			col++
+		}
+		if !added {
+			addResults()
+		}
+
+		out.Write(data[last:m[0]])
+		fmt.Fprintf(&out, "<%srow%s>%s</%srow>", prefix, xlsxSpansRe.ReplaceAllString(attrs, ""), strings.Join(cells, ""), prefix)
+		last = m[1]
+	}
+	out.Write(data[last:])
+	return out.Bytes()
+}
+
+func xlsxCell(prefix string, col, row int, value string) string {
+	var text bytes.Buffer
+	xml.EscapeText(&text, []byte(value))
+	return fmt.Sprintf(`<%sc r="%s%d" t="inlineStr"><%sis><%st xml:space="preserve">%s</%st></%sis></%sc>`,
+		prefix, xlsxColumnName(col), row, prefix, prefix, text.String(), prefix, prefix, prefix)
+}
+
+// ODS keeps every table in content.xml. Rows and cells have repeat counts, so that a sheet doesn't need a million
+// empty rows, which have to be counted to know where we are.
+var (
+	odsTableRe       = regexp.MustCompile(`(?s)<table:table\s[^>]*>.*?</table:table>`)
+	odsTableNameRe   = regexp.MustCompile(`^<table:table\s[^>]*?table:name="([^"]*)"`)
+	odsRowRe         = regexp.MustCompile(`(?s)<table:table-row(\s[^>]*?)?(/>|>(.*?)</table:table-row>)`)
+	odsCellRe        = regexp.MustCompile(`(?s)<table:(?:covered-)?table-cell(?:\s[^>]*?)?(?:/>|>.*?</table:(?:covered-)?table-cell>)`)
+	odsRowRepeatRe   = regexp.MustCompile(`\stable:number-rows-repeated="(\d+)"`)
+	odsCellRepeatRe  = regexp.MustCompile(`\stable:number-columns-repeated="(\d+)"`)
+	odsStartTagRe    = regexp.MustCompile(`^<table:(?:covered-)?table-cell`)
+	odsUnescapeAttrs = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">", "&quot;", `"`, "&apos;", "'")
+)
+
+// Find the named table, the first one if name is empty
+func odsTable(data []byte, name string) (start, end int, tableName string, err error) {
+	for _, m := range odsTableRe.FindAllIndex(data, -1) {
+		n := odsTableNameRe.FindSubmatch(data[m[0]:m[1]])
+		if n == nil {
+			continue
+		}
+		tableName = odsUnescapeAttrs.Replace(string(n[1]))
+		if name == "" || name == tableName {
+			return m[0], m[1], tableName, nil
+		}
+	}
+	return 0, 0, "", fmt.Errorf("no worksheet %q in the workbook", name)
+}
+
+func repeatCount(re *regexp.Regexp, tag string) int {
+	if m := re.FindStringSubmatch(tag); m != nil {
+		if n, err := strconv.Atoi(m[1]); err == nil && n > 0 {
+			return n
+		}
+	}
+	return 1
+}
+
+func (book *Workbook) readODS(z *zip.Reader, sheet string) ([]sheetRow, error) {
+	book.part = "content.xml"
+	var data []byte
+	for _, f := range z.File {
+		if f.Name == book.part {
+			var err error
+			if data, err = readZipFile(f); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if data == nil {
+		return nil, errors.New("no content.xml in the workbook")
+	}
+	start, end, name, err := odsTable(data, sheet)
+	if err != nil {
+		return nil, err
+	}
+	book.sheet = name
+
+	var rows []sheetRow
+	num := 1
+	for _, m := range odsRowRe.FindAllSubmatchIndex(data[start:end], -1) {
+		attrs := ""
+		if m[2] >= 0 {
+			attrs = string(data[start+m[2] : start+m[3]])
+		}
+		repeat := repeatCount(odsRowRepeatRe, attrs)
+		if m[6] >= 0 {
+			row := sheetRow{num: num}
+			empty := 0 // empty cells are only added once something follows them, so trailing ones never are
+			for _, cell := range odsCellRe.FindAllString(string(data[start+m[6]:start+m[7]]), -1) {
+				n := repeatCount(odsCellRepeatRe, cell[:strings.Index(cell, ">")])
+				value, err := odsCellValue(cell)
+				if err != nil {
+					return nil, fmt.Errorf("row %d: %v", num, err)
+				}
+				if value == "" {
+					empty += n
+					continue
+				}
+				for ; empty > 0; empty-- {
+					row.cells = append(row.cells, "")
+				}
+				for i := 0; i < n; i++ {
+					row.cells = append(row.cells, value)
+				}
+			}
+			for i := 0; i < repeat && len(row.cells) > 0; i++ {
+				rows = append(rows, sheetRow{num: num + i, cells: row.cells})
+			}
+		}
+		num += repeat
+	}
+	return rows, nil
+}
+
+// The value of a cell: the number itself for numeric cells rather than however it is displayed, otherwise the text
+// with one line per paragraph
+func odsCellValue(cell string) (string, error) {
+	var valueType, value, boolean string
+	dec := xml.NewDecoder(strings.NewReader(cell))
+	var text strings.Builder
+	paragraphs, skip := 0, 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			switch {
+			case skip > 0 || tok.Name.Local == "annotation":
+				skip++
+			case tok.Name.Local == "table-cell" || tok.Name.Local == "covered-table-cell":
+				for _, a := range tok.Attr {
+					switch a.Name.Local {
+					case "value-type":
+						valueType = a.Value
+					case "value":
+						value = a.Value
+					case "boolean-value":
+						boolean = a.Value
+					}
+				}
+			case tok.Name.Local == "p":
+				if paragraphs > 0 {
+					text.WriteString("\n")
+				}
+				paragraphs++
+			case tok.Name.Local == "s":
+				n := 1
+				for _, a := range tok.Attr {
+					if a.Name.Local == "c" {
+						n, _ = strconv.Atoi(a.Value)
+					}
+				}
+				text.WriteString(strings.Repeat(" ", n))
+			case tok.Name.Local == "tab":
+				text.WriteString("\t")
+			case tok.Name.Local == "line-break":
+				text.WriteString("\n")
+			}
+		case xml.EndElement:
+			if skip > 0 {
+				skip--
+			}
+		case xml.CharData:
+			if skip == 0 && paragraphs > 0 {
+				text.Write(tok)
+			}
+		}
+	}
+	switch valueType {
+	case "float", "percentage", "currency":
+		return value, nil
+	case "boolean":
+		return boolean, nil
+	}
+	return text.String(), nil
+}
+
+func fillODS(data []byte, sheet string, results map[int][]string) ([]byte, error) {
+	start, end, _, err := odsTable(data, sheet)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	out.Write(data[:start])
+	table := data[start:end]
+	num, last := 1, 0
+	for _, m := range odsRowRe.FindAllSubmatchIndex(table, -1) {
+		attrs := ""
+		if m[2] >= 0 {
+			attrs = string(table[m[2]:m[3]])
+		}
+		repeat := repeatCount(odsRowRepeatRe, attrs)
+		values, ok := results[num]
+		num += repeat
+		if !ok || repeat != 1 || m[6] < 0 {
+			continue
+		}
+
+		// One cell per column up to the last result column, then whatever was there after it
+		var cells []string
+		col := 0
+		for _, cell := range odsCellRe.FindAllString(string(table[m[6]:m[7]]), -1) {
+			n := repeatCount(odsCellRepeatRe, cell[:strings.Index(cell, ">")])
+			for ; n > 0 && col <= SummaryColumn; n, col = n-1, col+1 {
+				cells = append(cells, odsSetRepeat(cell, 1))
+			}
+			if n > 0 {
+				cells = append(cells, odsSetRepeat(cell, n))
+				col += n
+			}
+		}
+		for ; col <= SummaryColumn; col++ {
+			cells = append(cells, "<table:table-cell/>")
+		}
+		for i, value := range values {
+			cells[ResultColumn+i] = odsCell(value)
+		}
+
+		out.Write(table[last:m[0]])
+		fmt.Fprintf(&out, "<table:table-row%s>%s</table:table-row>", attrs, strings.Join(cells, ""))
+		last = m[1]
+	}
+	out.Write(table[last:])
+	out.Write(data[end:])
+	return out.Bytes(), nil
+}
+
+// A copy of a cell repeated n times
+func odsSetRepeat(cell string, n int) string {
+	i := strings.Index(cell, ">")
+	if strings.HasSuffix(cell[:i], "/") {
+		i--
+	}
+	tag := odsCellRepeatRe.ReplaceAllString(cell[:i], "")
+	if n > 1 {
+		tag = odsStartTagRe.ReplaceAllString(tag, fmt.Sprintf(`$0 table:number-columns-repeated="%d"`, n))
+	}
+	return tag + cell[i:]
+}
+
+func odsCell(value string) string {
+	if value == "" {
+		return "<table:table-cell/>"
+	}
+	var text bytes.Buffer
+	xml.EscapeText(&text, []byte(value))
+	return `<table:table-cell office:value-type="string"><text:p>` + text.String() + `</text:p></table:table-cell>`
+}
@@ -0,0 +1,192 @@
+/*
+
+ Copyright (c) 2013 Bruce Fitzsimons
+
+ This program is free software; you can redistribute it and/or
+ modify it under the terms of the GNU General Public License
+ as published by the Free Software Foundation; either version 2
+ of the License, or (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program; if not, write to the Free Software
+ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Build a workbook from its parts, in order
+func writeTestWorkbook(t *testing.T, name string, parts ...string) string {
+	file := filepath.Join(t.TempDir(), name)
+	fd, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	w := zip.NewWriter(fd)
+	for i := 0; i < len(parts); i += 2 {
+		method := zip.Deflate
+		if parts[i] == "mimetype" {
+			method = zip.Store
+		}
+		f, err := w.CreateHeader(&zip.FileHeader{Name: parts[i], Method: method})
+		if err == nil {
+			_, err = f.Write([]byte(parts[i+1]))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func readTestWorkbook(t *testing.T, file, sheet string) ([][]string, *Workbook) {
+	fd, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	records, book, err := readWorkbookTests(fd, sheet)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", file, err)
+	}
+	return records, book
+}
+
+// Check what was read, and that the results written back read back as expected, with the rest of the row intact
+func checkWorkbook(t *testing.T, file, sheet string, want [][]string) {
+	records, book := readTestWorkbook(t, file, sheet)
+	if len(records) != len(want) {
+		t.Fatalf("Read %d tests, wanted %d: %q", len(records), len(want), records)
+	}
+	for i := range want {
+		if strings.Join(records[i], "|") != strings.Join(want[i], "|") {
+			t.Fatalf("Test %d read as %q, wanted %q", i+1, records[i], want[i])
+		}
+	}
+
+	tests := []Test{{run: true, passed: true, opts: &TestOptions{}}, {run: true, error: "Connection <refused> & more", opts: &TestOptions{}}}
+	out := filepath.Join(t.TempDir(), "results"+filepath.Ext(file))
+	if err := book.writeResults(out, tests); err != nil {
+		t.Fatal("Failed to write results:", err)
+	}
+	records, _ = readTestWorkbook(t, out, sheet)
+	results := [][]string{{"PASSED", ""}, {"FAILED", "Connection <refused> & more"}}
+	for i := range want {
+		row := append([]string{}, want[i]...)
+		for len(row) <= SummaryColumn {
+			row = append(row, "")
+		}
+		row[ResultColumn], row[SummaryColumn] = results[i][0], results[i][1]
+		if results[i][1] == "" && len(want[i]) <= SummaryColumn {
+			row = row[:SummaryColumn]
+		}
+		if strings.Join(records[i], "|") != strings.Join(row, "|") {
+			t.Fatalf("Test %d with results read as %q, wanted %q", i+1, records[i], row)
+		}
+	}
+}
+
+func TestXLSXWorkbook(t *testing.T) {
+	file := writeTestWorkbook(t, "tests.xlsx",
+		"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8"?><Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"/>`,
+		"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="Notes" sheetId="1" r:id="rId1"/><sheet name="Tests" sheetId="2" r:id="rId2"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>
+<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="/xl/worksheets/sheet2.xml"/>
+</Relationships>`,
+		"xl/sharedStrings.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<sst xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><si><t>web01</t></si><si><r><t>tcp</t></r><r><t>4</t></r></si><si><t>#comment</t></si></sst>`,
+		"xl/worksheets/sheet1.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData><row r="1"><c r="A1" t="s"><v>2</v></c></row></sheetData></worksheet>`,
+		"xl/worksheets/sheet2.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>
+<row r="1"><c r="A1" t="s"><v>2</v></c></row>
+<row r="2" spans="1:12"><c r="A2"><v>1</v></c><c r="C2" t="s"><v>0</v></c><c r="G2" t="inlineStr"><is><t>10.0.0.1:80</t></is></c><c r="I2" t="s"><v>1</v></c><c r="J2" t="inlineStr"><is><t>PENDING</t></is></c><c r="L2" t="inlineStr"><is><t>expect=deny</t></is></c></row>
+<row r="3"><c r="A3" t="inlineStr"><is><t>Reference</t></is></c><c r="B3" t="inlineStr"><is><t>Description</t></is></c><c r="C3" t="inlineStr"><is><t>Local Hostname</t></is></c><c r="D3" t="inlineStr"><is><t>Local IP:Port</t></is></c><c r="E3" t="inlineStr"><is><t>Local Description</t></is></c><c r="F3" t="inlineStr"><is><t>Remote Hostname</t></is></c><c r="G3" t="inlineStr"><is><t>Remote IP:Port</t></is></c><c r="H3" t="inlineStr"><is><t>Remote Description</t></is></c><c r="I3" t="inlineStr"><is><t>Protocol</t></is></c><c r="J3" t="inlineStr"><is><t>Result</t></is></c><c r="K3" t="inlineStr"><is><t>Summary</t></is></c></row>
+<row r="4"><c r="A4"><v>2</v></c><c r="C4" t="s"><v>0</v></c><c r="G4" t="inlineStr"><is><t>10.0.0.2:80</t></is></c><c r="I4" t="s"><v>1</v></c></row>
+<row r="5"><c r="A5" t="s"><v>2</v></c></row>
+<row r="6"><c r="A6" t="inlineStr"><is><t>Web servers</t></is></c><c r="C6" t="s"><v>0</v></c></row>
+</sheetData></worksheet>`)
+
+	checkWorkbook(t, file, "Tests", [][]string{
+		{"1", "", "web01", "", "", "", "10.0.0.1:80", "", "tcp4", "PENDING", "", "expect=deny"},
+		{"2", "", "web01", "", "", "", "10.0.0.2:80", "", "tcp4"},
+	})
+	if records, _ := readTestWorkbook(t, file, ""); len(records) != 0 {
+		t.Fatalf("The first sheet should be all comments: %q", records)
+	}
+}
+
+func TestODSWorkbook(t *testing.T) {
+	file := writeTestWorkbook(t, "tests.ods",
+		"mimetype", "application/vnd.oasis.opendocument.spreadsheet",
+		"content.xml", `<?xml version="1.0" encoding="UTF-8"?>
+<office:document-content xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:table="urn:oasis:names:tc:opendocument:xmlns:table:1.0" xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0">
+<office:body><office:spreadsheet>
+<table:table table:name="Notes"><table:table-row><table:table-cell office:value-type="string"><text:p>hello</text:p></table:table-cell></table:table-row></table:table>
+<table:table table:name="Tests &amp; results">
+<table:table-column table:number-columns-repeated="12"/>
+<table:table-row><table:table-cell office:value-type="string"><text:p>#format</text:p></table:table-cell></table:table-row>
+<table:table-row><table:table-cell office:value-type="float" office:value="1"><text:p>1.00</text:p></table:table-cell><table:table-cell/><table:table-cell office:value-type="string"><text:p>web01</text:p></table:table-cell><table:table-cell table:number-columns-repeated="3"/><table:table-cell office:value-type="string"><text:p>10.0.0.1:<text:span>80</text:span></text:p></table:table-cell><table:table-cell/><table:table-cell office:value-type="string"><text:p>tcp4</text:p></table:table-cell><table:table-cell table:number-columns-repeated="2"/><table:table-cell office:value-type="string"><text:p>expect=deny</text:p></table:table-cell><table:table-cell table:number-columns-repeated="1012"/></table:table-row>
+<table:table-row table:number-rows-repeated="2"><table:table-cell table:number-columns-repeated="1024"/></table:table-row>
+<table:table-row><table:table-cell office:value-type="float" office:value="2"><text:p>2</text:p></table:table-cell><table:table-cell/><table:table-cell office:value-type="string"><text:p>web01</text:p></table:table-cell><table:table-cell table:number-columns-repeated="3"/><table:table-cell office:value-type="string"><text:p>10.0.0.2:80</text:p><office:annotation><text:p>ignored</text:p></office:annotation></table:table-cell><table:table-cell/><table:table-cell office:value-type="string"><text:p>tcp4</text:p></table:table-cell><table:table-cell table:number-columns-repeated="1015"/></table:table-row>
+<table:table-row table:number-rows-repeated="1048570"><table:table-cell table:number-columns-repeated="1024"/></table:table-row>
+</table:table>
+</office:spreadsheet></office:body></office:document-content>`)
+
+	checkWorkbook(t, file, "Tests & results", [][]string{
+		{"1", "", "web01", "", "", "", "10.0.0.1:80", "", "tcp4", "", "", "expect=deny"},
+		{"2", "", "web01", "", "", "", "10.0.0.2:80", "", "tcp4"},
+	})
+
+	fd, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	if _, _, err = readWorkbookTests(fd, "Missing"); err == nil {
+		t.Fatal("Read tests from a missing worksheet")
+	}
+}
+
+func TestXLSXColumn(t *testing.T) {
+	var tests = []struct {
+		Ref  string
+		Col  int
+		Name string
+	}{
+		{"A1", 0, "A"},
+		{"J12", 9, "J"},
+		{"Z3", 25, "Z"},
+		{"AA3", 26, "AA"},
+		{"BA1", 52, "BA"},
+	}
+	for count, test := range tests {
+		if col := xlsxColumn(test.Ref); col != test.Col || xlsxColumnName(col) != test.Name {
+			t.Fatalf("Line %d %s should be column %d %s, got %d %s", count+1, test.Ref, test.Col, test.Name, col, xlsxColumnName(col))
+		}
+	}
+	if xlsxColumn("12") != -1 {
+		t.Fatal("A reference without a column has one")
+	}
+}